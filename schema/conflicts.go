@@ -0,0 +1,411 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConflictPolicy decides what happens when several services define a type with the same name
+type ConflictPolicy int
+
+const (
+	// ConflictPolicyMerge shares the type between the services, every field is owned by the first service defining it.
+	// A query for a field is refused if the service answering the query does not define it like its owner
+	ConflictPolicyMerge ConflictPolicy = iota
+	// ConflictPolicyFirstWins takes the whole type from the service with the highest priority
+	ConflictPolicyFirstWins
+	// ConflictPolicyFail refuses to build a schema with conflicting types
+	ConflictPolicyFail
+)
+
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	switch strings.ToLower(value) {
+	case "", "merge":
+		return ConflictPolicyMerge, nil
+	case "first-wins", "firstwins":
+		return ConflictPolicyFirstWins, nil
+	case "fail":
+		return ConflictPolicyFail, nil
+	default:
+		return ConflictPolicyMerge, errors.New("Unknown conflict policy " + value)
+	}
+}
+
+func (p ConflictPolicy) String() string {
+	switch p {
+	case ConflictPolicyFirstWins:
+		return "first-wins"
+	case ConflictPolicyFail:
+		return "fail"
+	default:
+		return "merge"
+	}
+}
+
+// ParseServicePriorities reads priorities in the form "users=10,inventory=5"
+func ParseServicePriorities(value string) (map[string]int, error) {
+	entries, err := parseServiceMap(value)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]int)
+	for name, entry := range entries {
+		priority, err := strconv.Atoi(entry)
+		if err != nil {
+			return nil, errors.New("Invalid service priority " + name + "=" + entry)
+		}
+
+		result[name] = priority
+	}
+
+	return result, nil
+}
+
+type TypeConflict struct {
+	TypeName   string   `json:"typeName"`
+	FieldName  string   `json:"fieldName,omitempty"`
+	Services   []string `json:"services"`
+	Resolution string   `json:"resolution"`
+}
+
+func (c TypeConflict) String() string {
+	name := c.TypeName
+	if c.FieldName != "" {
+		name += "." + c.FieldName
+	}
+
+	return fmt.Sprintf("%v defined by %v: %v", name, strings.Join(c.Services, ", "), c.Resolution)
+}
+
+// RootFieldOwner is the service a field of Query, Mutation or Subscription is routed to
+type RootFieldOwner struct {
+	TypeName  string `json:"typeName"`
+	FieldName string `json:"fieldName"`
+	Service   string `json:"service"`
+}
+
+type BuildReport struct {
+	Services       []string         `json:"services"`
+	Conflicts      []TypeConflict   `json:"conflicts"`
+	RootFields     []RootFieldOwner `json:"rootFields"`
+	FailedServices []SchemaError    `json:"failedServices"`
+}
+
+func (r *BuildReport) addConflict(conflict TypeConflict) {
+	r.Conflicts = append(r.Conflicts, conflict)
+}
+
+func (r BuildReport) getRootFieldConflicts() []TypeConflict {
+	result := make([]TypeConflict, 0)
+	for _, conflict := range r.Conflicts {
+		if isRootTypeName(conflict.TypeName) && conflict.FieldName != "" {
+			result = append(result, conflict)
+		}
+	}
+
+	return result
+}
+
+// getRootFieldError blames duplicate root fields on the service claiming them last, the one with the lower priority,
+// so only that service is left out of the schema
+func (r BuildReport) getRootFieldError() *SchemaError {
+	conflicts := r.getRootFieldConflicts()
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	service := conflicts[0].Services[1]
+	duplicates := make([]string, 0)
+	for _, conflict := range conflicts {
+		if conflict.Services[1] == service {
+			duplicates = append(duplicates, conflict.String())
+		}
+	}
+
+	return newSchemaError(service, "", errors.New("Duplicate root fields: "+strings.Join(duplicates, "; ")))
+}
+
+func (r BuildReport) Error() error {
+	if len(r.Conflicts) == 0 {
+		return nil
+	}
+
+	conflicts := make([]string, 0)
+	for _, conflict := range r.Conflicts {
+		conflicts = append(conflicts, conflict.String())
+	}
+
+	return errors.New("Conflicting types: " + strings.Join(conflicts, "; "))
+}
+
+type fieldOwnership struct {
+	service   string
+	signature string
+}
+
+func getTypeRefString(fieldType *FieldType) string {
+	switch fieldType.Kind {
+	case "NON_NULL":
+		return getTypeRefString(fieldType.OfType) + "!"
+	case "LIST":
+		return "[" + getTypeRefString(fieldType.OfType) + "]"
+	default:
+		if fieldType.Name == nil {
+			return fieldType.Kind
+		}
+		return *fieldType.Name
+	}
+}
+
+func getArgsSignature(args []FieldArg) string {
+	argStrings := make([]string, 0)
+	for i := range args {
+		argStrings = append(argStrings, args[i].Name+":"+getTypeRefString(&args[i].Type))
+	}
+	sort.Strings(argStrings)
+
+	return "(" + strings.Join(argStrings, ",") + ")"
+}
+
+func getFieldSignature(field TypeField) string {
+	return getArgsSignature(field.Args) + ":" + getTypeRefString(&field.Type)
+}
+
+func getTypeRefNames(typeRefs []FieldType) string {
+	names := make([]string, 0)
+	for i := range typeRefs {
+		names = append(names, getTypeRefString(&typeRefs[i]))
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
+}
+
+// two definitions of a type are considered equal if they have the same shape, descriptions are ignored
+func getTypeSignature(schemaType Type) string {
+	parts := []string{schemaType.Kind}
+
+	fields := make([]string, 0)
+	for _, field := range schemaType.Fields {
+		fields = append(fields, field.Name+getFieldSignature(field))
+	}
+	sort.Strings(fields)
+	parts = append(parts, strings.Join(fields, ","))
+
+	parts = append(parts, getArgsSignature(schemaType.InputFields))
+
+	enumValues := make([]string, 0)
+	for _, enumValue := range schemaType.EnumValues {
+		enumValues = append(enumValues, enumValue.Name)
+	}
+	sort.Strings(enumValues)
+	parts = append(parts, strings.Join(enumValues, ","))
+
+	parts = append(parts, getTypeRefNames(schemaType.Interfaces), getTypeRefNames(schemaType.PossibleTypes))
+
+	return strings.Join(parts, "|")
+}
+
+func isRootTypeName(typeName string) bool {
+	return typeName == "Query" || typeName == "Mutation" || typeName == "Subscription"
+}
+
+// services are merged by descending priority and then by name, so the result does not depend on map iteration
+func (m *MergedSchemas) getOrderedServiceSchemas() []RemoteSchema {
+	names := make([]string, 0)
+	for name := range m.serviceSchemas {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		if m.Priorities[names[i]] != m.Priorities[names[j]] {
+			return m.Priorities[names[i]] > m.Priorities[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	result := make([]RemoteSchema, 0)
+	for _, name := range names {
+		result = append(result, m.serviceSchemas[name])
+	}
+
+	return result
+}
+
+// scanTypeOwners decides which service owns each type and records conflicting type definitions
+func (m *schemaBuild) scanTypeOwners(remoteSchemas []RemoteSchema) {
+	signatures := make(map[string]string)
+	kinds := make(map[string]string)
+	definingServices := make(map[string][]string)
+	conflicting := make(map[string]bool)
+	typeNames := make([]string, 0)
+
+	for _, remoteSchema := range remoteSchemas {
+		serviceName := remoteSchema.ServiceInfo.Name
+
+		for _, schemaType := range remoteSchema.SchemaResponse.Data.Schema.Types {
+			if strings.HasPrefix(schemaType.Name, "__") {
+				continue
+			}
+
+			signature := getTypeSignature(schemaType)
+			m.recordServiceFields(serviceName, schemaType)
+
+			if _, known := m.typeOwners[schemaType.Name]; !known {
+				m.typeOwners[schemaType.Name] = serviceName
+				signatures[schemaType.Name] = signature
+				kinds[schemaType.Name] = schemaType.Kind
+				typeNames = append(typeNames, schemaType.Name)
+			} else if signatures[schemaType.Name] != signature {
+				conflicting[schemaType.Name] = true
+			}
+
+			if kinds[schemaType.Name] != schemaType.Kind {
+				m.kindConflicts[schemaType.Name] = true
+			}
+
+			definingServices[schemaType.Name] = append(definingServices[schemaType.Name], serviceName)
+		}
+	}
+
+	for _, typeName := range typeNames {
+		if !conflicting[typeName] || isRootTypeName(typeName) {
+			continue
+		}
+
+		resolution := "merged, fields are owned by the first service defining them"
+		if m.ConflictPolicy == ConflictPolicyFail {
+			resolution = "rejected"
+		} else if m.ConflictPolicy == ConflictPolicyFirstWins || m.kindConflicts[typeName] {
+			resolution = "taken from " + m.typeOwners[typeName]
+		}
+
+		m.report.addConflict(TypeConflict{
+			TypeName:   typeName,
+			Services:   definingServices[typeName],
+			Resolution: resolution,
+		})
+	}
+}
+
+// getOwnedTypes filters the types of a service down to the ones it contributes to the merged schema
+func (m *schemaBuild) getOwnedTypes(remoteSchema RemoteSchema) []Type {
+	serviceName := remoteSchema.ServiceInfo.Name
+	result := make([]Type, 0)
+
+	for _, schemaType := range remoteSchema.SchemaResponse.Data.Schema.Types {
+		owner := m.typeOwners[schemaType.Name]
+
+		if owner != serviceName && !isRootTypeName(schemaType.Name) {
+			if m.ConflictPolicy == ConflictPolicyFirstWins || m.kindConflicts[schemaType.Name] {
+				continue
+			}
+		}
+
+		result = append(result, schemaType)
+	}
+
+	return result
+}
+
+// claimField returns whether the service gets to define the field, the first service defining a field owns it
+func (m *schemaBuild) claimField(typeName string, field TypeField, serviceName string) bool {
+	owners := m.fieldOwners[typeName]
+	if owners == nil {
+		owners = make(map[string]fieldOwnership)
+		m.fieldOwners[typeName] = owners
+	}
+
+	signature := getFieldSignature(field)
+
+	owner, owned := owners[field.Name]
+	if !owned {
+		owners[field.Name] = fieldOwnership{service: serviceName, signature: signature}
+		return true
+	}
+
+	if owner.service == serviceName {
+		return false
+	}
+
+	//the same root field in two services makes routing ambiguous, even if both definitions are equal
+	if isRootTypeName(typeName) {
+		resolution := "routed to " + owner.service
+		if m.RejectDuplicateRootFields {
+			resolution = "rejected"
+		}
+
+		m.report.addConflict(TypeConflict{
+			TypeName:   typeName,
+			FieldName:  field.Name,
+			Services:   []string{owner.service, serviceName},
+			Resolution: resolution,
+		})
+	} else if owner.signature != signature {
+		m.report.addConflict(TypeConflict{
+			TypeName:   typeName,
+			FieldName:  field.Name,
+			Services:   []string{owner.service, serviceName},
+			Resolution: "owned by " + owner.service + ", not queried from " + serviceName,
+		})
+	}
+
+	return false
+}
+
+func (m *schemaBuild) getRootFieldOwners() []RootFieldOwner {
+	result := make([]RootFieldOwner, 0)
+
+	for typeName, owners := range m.fieldOwners {
+		if !isRootTypeName(typeName) {
+			continue
+		}
+
+		for fieldName, owner := range owners {
+			result = append(result, RootFieldOwner{
+				TypeName:  typeName,
+				FieldName: fieldName,
+				Service:   owner.service,
+			})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].TypeName != result[j].TypeName {
+			return result[i].TypeName < result[j].TypeName
+		}
+		return result[i].FieldName < result[j].FieldName
+	})
+
+	return result
+}
+
+// RootFieldOwners returns the routing table of the last built schema
+func (m *MergedSchemas) RootFieldOwners() []RootFieldOwner {
+	return m.Report().RootFields
+}
+
+// FieldOwner returns the name of the service owning a field of the merged schema
+func (m *MergedSchemas) FieldOwner(typeName string, fieldName string) (string, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.current == nil {
+		return "", false
+	}
+
+	owner, owned := m.current.fieldOwners[typeName][fieldName]
+	return owner.service, owned
+}
+
+// Report describes the last build, including builds that failed
+func (m *MergedSchemas) Report() BuildReport {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.report
+}
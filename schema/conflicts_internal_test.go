@@ -0,0 +1,215 @@
+package schema
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dukfaar/goUtils/eventbus"
+)
+
+const usersItemSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[
+		{"kind":"OBJECT","name":"Query","fields":[
+			{"name":"item","args":[],"type":{"kind":"OBJECT","name":"Item"}}
+		]},
+		{"kind":"OBJECT","name":"Item","fields":[
+			{"name":"id","args":[],"type":{"kind":"SCALAR","name":"ID"}},
+			{"name":"owner","args":[],"type":{"kind":"SCALAR","name":"String"}}
+		]}
+	]
+}}}`
+
+const inventoryItemSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[
+		{"kind":"OBJECT","name":"Query","fields":[
+			{"name":"items","args":[],"type":{"kind":"LIST","ofType":{"kind":"OBJECT","name":"Item"}}}
+		]},
+		{"kind":"OBJECT","name":"Item","fields":[
+			{"name":"id","args":[],"type":{"kind":"SCALAR","name":"Int"}},
+			{"name":"stock","args":[],"type":{"kind":"SCALAR","name":"Int"}}
+		]}
+	]
+}}}`
+
+func newConflictingSchemas(t *testing.T, policy ConflictPolicy) *MergedSchemas {
+	mergedSchema := &MergedSchemas{ConflictPolicy: policy}
+	mergedSchema.AddService(eventbus.ServiceInfo{Name: "users"}, parseSchemaResponse(t, usersItemSchemaJSON))
+	mergedSchema.AddService(eventbus.ServiceInfo{Name: "inventory"}, parseSchemaResponse(t, inventoryItemSchemaJSON))
+	return mergedSchema
+}
+
+func TestConflictPolicyFail(t *testing.T) {
+	mergedSchema := newConflictingSchemas(t, ConflictPolicyFail)
+
+	if _, err := mergedSchema.BuildSchema(); err == nil {
+		t.Fatal("conflicting types were merged")
+	}
+
+	conflicts := mergedSchema.Report().Conflicts
+	if len(conflicts) != 1 || conflicts[0].TypeName != "Item" {
+		t.Errorf("unexpected conflicts %+v", conflicts)
+	}
+}
+
+func TestConflictPolicyFirstWinsUsesPriority(t *testing.T) {
+	mergedSchema := newConflictingSchemas(t, ConflictPolicyFirstWins)
+	mergedSchema.Priorities = map[string]int{"users": 10}
+
+	if _, err := mergedSchema.BuildSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := mergedSchema.current.types["Item"].Fields()
+	if fields["owner"] == nil || fields["stock"] != nil {
+		t.Errorf("Item was not taken from the service with the highest priority: %+v", fields)
+	}
+	if owner, _ := mergedSchema.FieldOwner("Item", "id"); owner != "users" {
+		t.Errorf("Item.id owned by %v", owner)
+	}
+}
+
+func TestConflictPolicyMergeOwnsFieldsPerService(t *testing.T) {
+	mergedSchema := newConflictingSchemas(t, ConflictPolicyMerge)
+
+	if _, err := mergedSchema.BuildSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := mergedSchema.current.types["Item"].Fields()
+	if fields["owner"] == nil || fields["stock"] == nil {
+		t.Errorf("Item fields were not merged: %+v", fields)
+	}
+
+	//without priorities the services are ordered by name
+	if owner, _ := mergedSchema.FieldOwner("Item", "id"); owner != "inventory" {
+		t.Errorf("Item.id owned by %v", owner)
+	}
+	if owner, _ := mergedSchema.FieldOwner("Item", "owner"); owner != "users" {
+		t.Errorf("Item.owner owned by %v", owner)
+	}
+
+	fieldConflicts := 0
+	for _, conflict := range mergedSchema.Report().Conflicts {
+		if conflict.TypeName == "Item" && conflict.FieldName == "id" {
+			fieldConflicts++
+		}
+	}
+	if fieldConflicts != 1 {
+		t.Errorf("field conflict not reported: %+v", mergedSchema.Report().Conflicts)
+	}
+}
+
+func TestMergedFieldsAreOnlyQueriedFromTheirServices(t *testing.T) {
+	users := newRecordingService(`{"data":{"item":{"owner":"bob"}}}`)
+	defer users.server.Close()
+	inventory := newRecordingService(`{"data":{"items":[{"id":1,"stock":3}]}}`)
+	defer inventory.server.Close()
+
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(users.serviceInfo("users"), parseSchemaResponse(t, usersItemSchemaJSON))
+	mergedSchema.AddService(inventory.serviceInfo("inventory"), parseSchemaResponse(t, inventoryItemSchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := executeQuery(schema, `{ item { owner } items { id stock } }`)
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+
+	//users does not define Item.stock and its Item.id is an ID, not the Int of the merged field
+	failing := []struct {
+		query   string
+		message string
+	}{
+		{`{ items { owner } }`, "Field Item.owner is not provided by service inventory"},
+		{`{ item { id } }`, "Field Item.id of service users conflicts with the one of service inventory"},
+		{`{ item { ...stock } } fragment stock on Item { stock }`, "Field Item.stock is not provided by service users"},
+	}
+	for _, failure := range failing {
+		result := executeQuery(schema, failure.query)
+		if len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Message, failure.message) {
+			t.Errorf("%v: unexpected errors %+v", failure.query, result.Errors)
+		}
+	}
+
+	if len(users.queries) != 1 || len(inventory.queries) != 1 {
+		t.Errorf("fields of other services were forwarded: %v, %v", users.queries, inventory.queries)
+	}
+}
+
+func TestParseServicePriorities(t *testing.T) {
+	priorities, err := ParseServicePriorities("users=10, inventory=-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if priorities["users"] != 10 || priorities["inventory"] != -1 {
+		t.Errorf("unexpected priorities %+v", priorities)
+	}
+
+	if _, err := ParseServicePriorities("users"); err == nil {
+		t.Error("invalid priority accepted")
+	}
+}
+
+const duplicateRootFieldSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[
+		{"kind":"OBJECT","name":"Query","fields":[
+			{"name":"item","args":[],"type":{"kind":"OBJECT","name":"Item"}}
+		]},
+		{"kind":"OBJECT","name":"Item","fields":[
+			{"name":"id","args":[],"type":{"kind":"SCALAR","name":"ID"}},
+			{"name":"owner","args":[],"type":{"kind":"SCALAR","name":"String"}}
+		]}
+	]
+}}}`
+
+func TestRootFieldOwners(t *testing.T) {
+	mergedSchema := newConflictingSchemas(t, ConflictPolicyMerge)
+	mergedSchema.AddService(eventbus.ServiceInfo{Name: "archive"}, parseSchemaResponse(t, duplicateRootFieldSchemaJSON))
+	mergedSchema.Priorities = map[string]int{"users": 1}
+
+	if _, err := mergedSchema.BuildSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	owners := mergedSchema.RootFieldOwners()
+	expected := []RootFieldOwner{
+		{TypeName: "Query", FieldName: "item", Service: "users"},
+		{TypeName: "Query", FieldName: "items", Service: "inventory"},
+	}
+	if !reflect.DeepEqual(owners, expected) {
+		t.Errorf("unexpected owners %+v", owners)
+	}
+
+	duplicates := 0
+	for _, conflict := range mergedSchema.Report().Conflicts {
+		if conflict.TypeName == "Query" && conflict.FieldName == "item" {
+			duplicates++
+		}
+	}
+	if duplicates != 1 {
+		t.Errorf("duplicate root field not reported: %+v", mergedSchema.Report().Conflicts)
+	}
+
+	//only the service duplicating the root field is left out, the conflict of Item is not blamed on it
+	mergedSchema.RejectDuplicateRootFields = true
+	if _, err := mergedSchema.BuildSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := mergedSchema.Report().FailedServices
+	if len(failed) != 1 || failed[0].Service != "archive" ||
+		failed[0].Message != "Duplicate root fields: Query.item defined by users, archive: rejected" {
+		t.Errorf("unexpected failed services %+v", failed)
+	}
+	if owners := mergedSchema.RootFieldOwners(); !reflect.DeepEqual(owners, expected) {
+		t.Errorf("unexpected owners %+v", owners)
+	}
+}
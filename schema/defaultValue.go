@@ -0,0 +1,64 @@
+package schema
+
+import (
+	"fmt"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+func (m *schemaBuild) valueFromAST(value ast.Value, valueType graphql.Input) interface{} {
+	switch valueType := valueType.(type) {
+	case *graphql.NonNull:
+		return m.valueFromAST(value, valueType.OfType)
+	case *graphql.List:
+		listValue, ok := value.(*ast.ListValue)
+		if !ok {
+			return []interface{}{m.valueFromAST(value, valueType.OfType)}
+		}
+
+		result := make([]interface{}, 0)
+		for _, item := range listValue.Values {
+			result = append(result, m.valueFromAST(item, valueType.OfType))
+		}
+		return result
+	case *graphql.InputObject:
+		objectValue, ok := value.(*ast.ObjectValue)
+		if !ok {
+			return nil
+		}
+
+		//the fields of input objects are not final while the schema is built, so their types are looked up in the scanned field types
+		result := make(map[string]interface{})
+		for _, field := range objectValue.Fields {
+			fieldType := m.inputFieldTypes[valueType.Name()][field.Name.Value]
+			if fieldType == nil {
+				continue
+			}
+			result[field.Name.Value] = m.valueFromAST(field.Value, fieldType)
+		}
+		return result
+	case *graphql.Scalar:
+		return valueType.ParseLiteral(value)
+	case *graphql.Enum:
+		return valueType.ParseLiteral(value)
+	default:
+		return nil
+	}
+}
+
+// introspection returns default values as graphql literals, they are parsed into go values of the argument type
+func (m *schemaBuild) getDefaultValue(defaultValue *string, valueType graphql.Input) interface{} {
+	if defaultValue == nil || *defaultValue == "" || *defaultValue == "null" {
+		return nil
+	}
+
+	value, err := parser.ParseValue(parser.ParseParams{Source: *defaultValue})
+	if err != nil {
+		fmt.Printf("Error parsing default value %v: %v\n", *defaultValue, err)
+		return nil
+	}
+
+	return m.valueFromAST(value, valueType)
+}
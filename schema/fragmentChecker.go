@@ -11,10 +11,51 @@ import (
 type FragmentChecker struct {
 	Fragments     map[string]ast.Definition
 	UsedFragments map[string]bool
+	UsedVariables map[string]bool
+}
+
+func NewFragmentChecker(fragments map[string]ast.Definition) *FragmentChecker {
+	return &FragmentChecker{
+		Fragments:     fragments,
+		UsedFragments: make(map[string]bool),
+		UsedVariables: make(map[string]bool),
+	}
+}
+
+func (c *FragmentChecker) MarkValue(value ast.Value) {
+	switch value := value.(type) {
+	case *ast.Variable:
+		c.UsedVariables[value.Name.Value] = true
+	case *ast.ListValue:
+		for _, item := range value.Values {
+			c.MarkValue(item)
+		}
+	case *ast.ObjectValue:
+		for _, field := range value.Fields {
+			c.MarkValue(field.Value)
+		}
+	}
+}
+
+func (c *FragmentChecker) MarkArguments(arguments []*ast.Argument) {
+	for _, argument := range arguments {
+		c.MarkValue(argument.Value)
+	}
+}
+
+func (c *FragmentChecker) MarkDirectives(directives []*ast.Directive) {
+	for _, directive := range directives {
+		c.MarkArguments(directive.Arguments)
+	}
 }
 
 func (c *FragmentChecker) MarkFragmentSpread(fragmentSpread *ast.FragmentSpread) {
 	c.UsedFragments[fragmentSpread.Name.Value] = true
+	c.MarkDirectives(fragmentSpread.Directives)
+
+	if fragment, ok := c.Fragments[fragmentSpread.Name.Value].(*ast.FragmentDefinition); ok {
+		c.MarkDirectives(fragment.Directives)
+	}
 
 	c.MarkSelectionSet(c.Fragments[fragmentSpread.Name.Value].GetSelectionSet())
 }
@@ -25,10 +66,11 @@ func (c *FragmentChecker) MarkSelection(selection ast.Selection) {
 		c.MarkFragmentSpread(selection.(*ast.FragmentSpread))
 	case *ast.Field:
 		c.MarkField(selection.(*ast.Field))
+	case *ast.InlineFragment:
+		c.MarkDirectives(selection.(*ast.InlineFragment).Directives)
+		c.MarkSelectionSet(selection.(*ast.InlineFragment).SelectionSet)
 	default:
-		fmt.Println("Unknown type: ")
-		fmt.Println(reflect.TypeOf(selection))
-		panic(1)
+		fmt.Printf("Unknown selection type: %v\n", reflect.TypeOf(selection))
 	}
 }
 
@@ -39,6 +81,9 @@ func (c *FragmentChecker) MarkSelectionSet(selectionSet *ast.SelectionSet) {
 }
 
 func (c *FragmentChecker) MarkField(field *ast.Field) {
+	c.MarkArguments(field.Arguments)
+	c.MarkDirectives(field.Directives)
+
 	if field.SelectionSet != nil {
 		c.MarkSelectionSet(field.SelectionSet)
 	}
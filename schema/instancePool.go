@@ -0,0 +1,157 @@
+package schema
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dukfaar/goUtils/eventbus"
+)
+
+// failedInstanceCooldown is how long an instance that failed a request is left out of the rotation
+var failedInstanceCooldown = 30 * time.Second
+
+func getInstanceKey(serviceInfo eventbus.ServiceInfo) string {
+	return serviceInfo.Hostname + ":" + serviceInfo.Port
+}
+
+type serviceInstance struct {
+	serviceInfo eventbus.ServiceInfo
+	lastSeen    time.Time
+	outstanding int
+	failedUntil time.Time
+}
+
+// instancePool holds the instances of one service, requests go to the instance with the least outstanding requests
+// and instances with the same load take turns
+type instancePool struct {
+	mutex     sync.Mutex
+	instances []*serviceInstance
+	next      int
+}
+
+func (p *instancePool) find(serviceInfo eventbus.ServiceInfo) int {
+	key := getInstanceKey(serviceInfo)
+	for i, instance := range p.instances {
+		if getInstanceKey(instance.serviceInfo) == key {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// add registers an instance or updates a known one, announced instances are taken back into the rotation
+func (p *instancePool) add(serviceInfo eventbus.ServiceInfo, seen time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if i := p.find(serviceInfo); i >= 0 {
+		p.instances[i].serviceInfo = serviceInfo
+		p.instances[i].lastSeen = seen
+		p.instances[i].failedUntil = time.Time{}
+		return
+	}
+
+	p.instances = append(p.instances, &serviceInstance{
+		serviceInfo: serviceInfo,
+		lastSeen:    seen,
+	})
+}
+
+func (p *instancePool) remove(serviceInfo eventbus.ServiceInfo) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	i := p.find(serviceInfo)
+	if i < 0 {
+		return false
+	}
+
+	p.instances = append(p.instances[:i], p.instances[i+1:]...)
+	return true
+}
+
+func (p *instancePool) markSeen(serviceInfo eventbus.ServiceInfo, seen time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if i := p.find(serviceInfo); i >= 0 && !seen.Before(p.instances[i].lastSeen) {
+		p.instances[i].lastSeen = seen
+		p.instances[i].failedUntil = time.Time{}
+	}
+}
+
+func (p *instancePool) expired(deadline time.Time) []eventbus.ServiceInfo {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	result := make([]eventbus.ServiceInfo, 0)
+	for _, instance := range p.instances {
+		if instance.lastSeen.Before(deadline) {
+			result = append(result, instance.serviceInfo)
+		}
+	}
+
+	return result
+}
+
+func (p *instancePool) serviceInfos() []eventbus.ServiceInfo {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	result := make([]eventbus.ServiceInfo, 0)
+	for _, instance := range p.instances {
+		result = append(result, instance.serviceInfo)
+	}
+
+	return result
+}
+
+func (p *instancePool) size() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.instances)
+}
+
+// acquire picks the instance for the next request, failed instances are only used if no other instance is left
+func (p *instancePool) acquire() (*serviceInstance, eventbus.ServiceInfo) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.instances) == 0 {
+		return nil, eventbus.ServiceInfo{}
+	}
+
+	now := time.Now()
+	var picked *serviceInstance
+	for i := range p.instances {
+		instance := p.instances[(p.next+i)%len(p.instances)]
+		if now.Before(instance.failedUntil) {
+			continue
+		}
+
+		if picked == nil || instance.outstanding < picked.outstanding {
+			picked = instance
+		}
+	}
+
+	if picked == nil {
+		picked = p.instances[p.next%len(p.instances)]
+	}
+
+	p.next = (p.next + 1) % len(p.instances)
+	picked.outstanding++
+
+	return picked, picked.serviceInfo
+}
+
+func (p *instancePool) release(instance *serviceInstance, failed bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	instance.outstanding--
+	if failed {
+		instance.failedUntil = time.Now().Add(failedInstanceCooldown)
+	}
+}
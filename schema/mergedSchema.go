@@ -2,12 +2,17 @@ package schema
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 
@@ -18,52 +23,196 @@ import (
 )
 
 type MergedSchemas struct {
-	serviceSchemas    map[string]RemoteSchema
-	types             map[string]*graphql.Object
-	inputTypes        map[string]*graphql.InputObject
-	typeExtensions    map[string]map[string]bool
-	serviceInfoByType map[string]eventbus.ServiceInfo
+	ConflictPolicy            ConflictPolicy
+	Priorities                map[string]int
+	RejectDuplicateRootFields bool
+	Namespaces                map[string]string
+	ServiceDown               func(serviceInfo eventbus.ServiceInfo)
+
+	serviceSchemas map[string]RemoteSchema
+	pools          map[string]*instancePool
+	monitors       map[string]*serviceMonitor
+
+	mutex   sync.RWMutex
+	current *schemaBuild
+	report  BuildReport
 }
 
-func (m *MergedSchemas) getTypeDefinition(fieldType *FieldType) graphql.Output {
+// schemaBuild holds everything derived from the services by one build,
+// it is not modified anymore once its schema is published, so resolvers of in-flight queries can keep using it
+type schemaBuild struct {
+	*MergedSchemas
+
+	schema             graphql.Schema
+	pools              map[string]*instancePool
+	types              map[string]*graphql.Object
+	interfaces         map[string]*graphql.Interface
+	unions             map[string]*graphql.Union
+	enums              map[string]*graphql.Enum
+	scalars            map[string]*graphql.Scalar
+	directives         map[string]*graphql.Directive
+	inputTypes         map[string]*graphql.InputObject
+	inputFieldTypes    map[string]map[string]graphql.Input
+	inputFields        map[string]graphql.InputObjectConfigFieldMap
+	implementations    map[string]map[string]bool
+	typeExtensions     map[string]map[string]bool
+	serviceInfoByType  map[string]eventbus.ServiceInfo
+	serviceFields      map[string]map[string]map[string]string
+	typeOwners         map[string]string
+	kindConflicts      map[string]bool
+	fieldOwners        map[string]map[string]fieldOwnership
+	report             BuildReport
+	namespaces         map[string]*namespace
+	originalTypeNames  map[string]map[string]string
+	originalFieldNames map[string]map[string]map[string]string
+
+	//root types of services are renamed per service, so they are translated apart from the namespaces
+	rootTypeNames map[string]*namespace
+
+	//probe builds only find out whether a schema can be built without some service
+	probe bool
+}
+
+func newSchemaBuild(m *MergedSchemas) *schemaBuild {
+	return &schemaBuild{
+		MergedSchemas:      m,
+		pools:              make(map[string]*instancePool),
+		types:              make(map[string]*graphql.Object),
+		interfaces:         make(map[string]*graphql.Interface),
+		unions:             make(map[string]*graphql.Union),
+		enums:              make(map[string]*graphql.Enum),
+		scalars:            make(map[string]*graphql.Scalar),
+		directives:         make(map[string]*graphql.Directive),
+		inputTypes:         make(map[string]*graphql.InputObject),
+		inputFieldTypes:    make(map[string]map[string]graphql.Input),
+		inputFields:        make(map[string]graphql.InputObjectConfigFieldMap),
+		implementations:    make(map[string]map[string]bool),
+		typeExtensions:     make(map[string]map[string]bool),
+		serviceInfoByType:  make(map[string]eventbus.ServiceInfo),
+		serviceFields:      make(map[string]map[string]map[string]string),
+		typeOwners:         make(map[string]string),
+		kindConflicts:      make(map[string]bool),
+		fieldOwners:        make(map[string]map[string]fieldOwnership),
+		namespaces:         make(map[string]*namespace),
+		originalTypeNames:  make(map[string]map[string]string),
+		originalFieldNames: make(map[string]map[string]map[string]string),
+
+		rootTypeNames: make(map[string]*namespace),
+	}
+}
+
+func (m *schemaBuild) getTypeDefinition(fieldType *FieldType) (graphql.Output, error) {
+	if fieldType == nil {
+		return nil, errors.New("Missing type reference")
+	}
+
+	switch fieldType.Kind {
+	case "NON_NULL":
+		ofType, err := m.getTypeDefinition(fieldType.OfType)
+		if err != nil {
+			return nil, err
+		}
+		return graphql.NewNonNull(ofType), nil
+	case "LIST":
+		ofType, err := m.getTypeDefinition(fieldType.OfType)
+		if err != nil {
+			return nil, err
+		}
+		return graphql.NewList(ofType), nil
+	}
+
+	if fieldType.Name == nil {
+		return nil, errors.New("Missing type name for kind " + fieldType.Kind)
+	}
+	name := *fieldType.Name
+
 	switch fieldType.Kind {
 	case "SCALAR":
-		return getScalarTypeDefinition(fieldType)
+		return m.getScalarTypeDefinition(fieldType), nil
 	case "OBJECT":
-		if m.types[*fieldType.Name] == nil {
-			panic("Object Type not defined " + *fieldType.Name)
+		if m.types[name] != nil {
+			return m.types[name], nil
+		}
+	case "INTERFACE":
+		if m.interfaces[name] != nil {
+			return m.interfaces[name], nil
+		}
+	case "UNION":
+		if m.unions[name] != nil {
+			return m.unions[name], nil
+		}
+	case "ENUM":
+		if m.enums[name] != nil {
+			return m.enums[name], nil
 		}
-		return m.types[*fieldType.Name]
 	case "INPUT_OBJECT":
-		if m.inputTypes[*fieldType.Name] == nil {
-			panic("InputObject Type not defined " + *fieldType.Name)
+		if m.inputTypes[name] != nil {
+			return m.inputTypes[name], nil
 		}
-		return m.inputTypes[*fieldType.Name]
-	case "NON_NULL":
-		return graphql.NewNonNull(m.getTypeDefinition(fieldType.OfType))
-	case "LIST":
-		return graphql.NewList(m.getTypeDefinition(fieldType.OfType))
 	default:
-		panic("Unknown Kind " + fieldType.Kind)
+		return nil, errors.New("Unknown Kind " + fieldType.Kind)
 	}
+
+	return nil, errors.New(fieldType.Kind + " Type not defined " + name)
 }
 
-func (m *MergedSchemas) scanType(schemaType Type, serviceInfo eventbus.ServiceInfo) {
+func (m *schemaBuild) scanType(schemaType Type, serviceInfo eventbus.ServiceInfo) error {
 	if schemaType.Kind == "SCALAR" || strings.HasPrefix(schemaType.Name, "__") {
-		return
+		return nil
 	}
 
 	switch schemaType.Kind {
 	case "SCALAR":
-		return
+		return nil
 	case "INPUT_OBJECT":
-		return
+		if m.inputTypes[schemaType.Name] == nil {
+			m.inputTypes[schemaType.Name] = graphql.NewInputObject(graphql.InputObjectConfig{
+				Name:        schemaType.Name,
+				Description: getDescription(schemaType.Description),
+				Fields:      m.createInputFieldsThunk(schemaType.Name),
+			})
+		}
+	case "UNION":
+		return nil
+	case "ENUM":
+		if m.enums[schemaType.Name] == nil {
+			m.enums[schemaType.Name] = graphql.NewEnum(graphql.EnumConfig{
+				Name:        schemaType.Name,
+				Description: getDescription(schemaType.Description),
+				Values:      getEnumValues(schemaType.EnumValues),
+			})
+			m.serviceInfoByType[schemaType.Name] = serviceInfo
+		}
 	case "INTERFACE":
-		return
+		for _, possibleType := range schemaType.PossibleTypes {
+			if possibleType.Name == nil {
+				return errors.New("Possible type without a name")
+			}
+			m.markImplementation(*possibleType.Name, schemaType.Name)
+		}
+
+		if m.interfaces[schemaType.Name] == nil {
+			m.interfaces[schemaType.Name] = graphql.NewInterface(graphql.InterfaceConfig{
+				Name:        schemaType.Name,
+				Description: getDescription(schemaType.Description),
+				Fields:      graphql.Fields{},
+				ResolveType: m.createResolveTypeFn(),
+			})
+			m.serviceInfoByType[schemaType.Name] = serviceInfo
+		}
 	case "OBJECT":
+		for _, implementedInterface := range schemaType.Interfaces {
+			if implementedInterface.Name == nil {
+				return errors.New("Implemented interface without a name")
+			}
+			m.markImplementation(schemaType.Name, *implementedInterface.Name)
+		}
+
 		newObject := graphql.NewObject(graphql.ObjectConfig{
-			Name:   schemaType.Name,
-			Fields: graphql.Fields{},
+			Name:        schemaType.Name,
+			Description: getDescription(schemaType.Description),
+			Fields:      graphql.Fields{},
+			Interfaces:  m.createInterfacesThunk(schemaType.Name),
 		})
 
 		if m.types[schemaType.Name] == nil {
@@ -71,46 +220,198 @@ func (m *MergedSchemas) scanType(schemaType Type, serviceInfo eventbus.ServiceIn
 			m.serviceInfoByType[schemaType.Name] = serviceInfo
 		}
 	default:
-		panic("Unknown kind " + schemaType.Kind)
+		return errors.New("Unknown kind " + schemaType.Kind)
 	}
+
+	return nil
 }
 
-func (m *MergedSchemas) scanTypes(typeList []Type, serviceInfo eventbus.ServiceInfo) {
-	for i := range typeList {
-		m.scanType(typeList[i], serviceInfo)
+func getDescription(description *string) string {
+	if description == nil {
+		return ""
 	}
+
+	return *description
 }
 
-func (m *MergedSchemas) scanInputType(schemaType Type) {
-	if schemaType.Kind == "INPUT_OBJECT" {
-		fields := graphql.InputObjectConfigFieldMap{}
+func getDeprecationReason(isDeprecated bool, deprecationReason *string) string {
+	if !isDeprecated {
+		return ""
+	}
+
+	if deprecationReason == nil || *deprecationReason == "" {
+		return graphql.DefaultDeprecationReason
+	}
 
-		for fieldIndex := range schemaType.InputFields {
-			field := schemaType.InputFields[fieldIndex]
+	return *deprecationReason
+}
 
-			fields[field.Name] = &graphql.InputObjectFieldConfig{
-				Type: m.getTypeDefinition(&field.Type),
+// enum values are kept as their names, so they are passed to the owning service unchanged
+func getEnumValues(enumValues []EnumValue) graphql.EnumValueConfigMap {
+	result := graphql.EnumValueConfigMap{}
+
+	for _, enumValue := range enumValues {
+		result[enumValue.Name] = &graphql.EnumValueConfig{
+			Value:             enumValue.Name,
+			Description:       getDescription(enumValue.Description),
+			DeprecationReason: getDeprecationReason(enumValue.IsDeprecated, enumValue.DeprecationReason),
+		}
+	}
+
+	return result
+}
+
+func (m *schemaBuild) markImplementation(objectName string, interfaceName string) {
+	t := m.implementations[objectName]
+	if t == nil {
+		t = make(map[string]bool)
+		m.implementations[objectName] = t
+	}
+	t[interfaceName] = true
+}
+
+// the interfaces are resolved lazily, so objects can be scanned before the interfaces they implement
+func (m *schemaBuild) createInterfacesThunk(objectName string) graphql.InterfacesThunk {
+	implementations := m.implementations
+	interfaces := m.interfaces
+
+	return func() []*graphql.Interface {
+		names := make([]string, 0)
+		for interfaceName := range implementations[objectName] {
+			if interfaces[interfaceName] != nil {
+				names = append(names, interfaceName)
 			}
 		}
+		sort.Strings(names)
 
-		newObject := graphql.NewInputObject(graphql.InputObjectConfig{
-			Name:   schemaType.Name,
-			Fields: fields,
-		})
+		result := make([]*graphql.Interface, 0)
+		for _, interfaceName := range names {
+			result = append(result, interfaces[interfaceName])
+		}
 
-		if m.inputTypes[schemaType.Name] == nil {
-			m.inputTypes[schemaType.Name] = newObject
+		return result
+	}
+}
+
+// abstract types are resolved by the __typename the owning service returned
+func (m *schemaBuild) createResolveTypeFn() graphql.ResolveTypeFn {
+	types := m.types
+
+	return func(p graphql.ResolveTypeParams) *graphql.Object {
+		value, ok := p.Value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		typename, ok := value["__typename"].(string)
+		if !ok {
+			return nil
+		}
+
+		return types[typename]
+	}
+}
+
+func (m *schemaBuild) isAbstractType(typeName string) bool {
+	return m.interfaces[typeName] != nil || m.unions[typeName] != nil
+}
+
+func (m *schemaBuild) getFieldDefinition(typeName string, fieldName string) *graphql.FieldDefinition {
+	if m.types[typeName] != nil {
+		return m.types[typeName].Fields()[fieldName]
+	}
+
+	if m.interfaces[typeName] != nil {
+		return m.interfaces[typeName].Fields()[fieldName]
+	}
+
+	return nil
+}
+
+// unions need their member objects at creation, so they are scanned after the objects of all services
+func (m *schemaBuild) scanUnionType(schemaType Type, serviceInfo eventbus.ServiceInfo) error {
+	if schemaType.Kind != "UNION" || m.unions[schemaType.Name] != nil {
+		return nil
+	}
+
+	memberTypes := make([]*graphql.Object, 0)
+	for _, possibleType := range schemaType.PossibleTypes {
+		if possibleType.Name == nil {
+			return errors.New("Union member without a name")
+		}
+
+		memberType := m.types[*possibleType.Name]
+		if memberType == nil {
+			return errors.New("Union member " + *possibleType.Name + " is not defined")
+		}
+		memberTypes = append(memberTypes, memberType)
+	}
+
+	m.unions[schemaType.Name] = graphql.NewUnion(graphql.UnionConfig{
+		Name:        schemaType.Name,
+		Description: getDescription(schemaType.Description),
+		Types:       memberTypes,
+		ResolveType: m.createResolveTypeFn(),
+	})
+	m.serviceInfoByType[schemaType.Name] = serviceInfo
+
+	return nil
+}
+
+// the fields of input objects are resolved lazily, so input objects can reference each other in any order
+func (m *schemaBuild) createInputFieldsThunk(typeName string) graphql.InputObjectConfigFieldMapThunk {
+	inputFields := m.inputFields
+
+	return func() graphql.InputObjectConfigFieldMap {
+		return inputFields[typeName]
+	}
+}
+
+func (m *schemaBuild) scanInputFieldTypes(schemaType Type, serviceInfo eventbus.ServiceInfo) error {
+	if schemaType.Kind != "INPUT_OBJECT" || m.inputFieldTypes[schemaType.Name] != nil {
+		return nil
+	}
+
+	fieldTypes := make(map[string]graphql.Input)
+	for fieldIndex := range schemaType.InputFields {
+		field := schemaType.InputFields[fieldIndex]
+
+		fieldType, err := m.getTypeDefinition(&field.Type)
+		if err != nil {
+			return errors.New("field " + field.Name + ": " + err.Error())
 		}
+		fieldTypes[field.Name] = fieldType
 	}
+
+	m.inputFieldTypes[schemaType.Name] = fieldTypes
+
+	return nil
 }
 
-func (m *MergedSchemas) scanInputTypes(typeList []Type) {
-	for i := range typeList {
-		m.scanInputType(typeList[i])
+// default values can reference other input objects, so they are parsed once the field types of all input objects are known
+func (m *schemaBuild) scanInputFields(schemaType Type, serviceInfo eventbus.ServiceInfo) error {
+	if schemaType.Kind != "INPUT_OBJECT" || m.inputFields[schemaType.Name] != nil {
+		return nil
+	}
+
+	fields := graphql.InputObjectConfigFieldMap{}
+	for fieldIndex := range schemaType.InputFields {
+		field := schemaType.InputFields[fieldIndex]
+
+		fieldType := m.inputFieldTypes[schemaType.Name][field.Name]
+		fields[field.Name] = &graphql.InputObjectFieldConfig{
+			Type:         fieldType,
+			Description:  getDescription(field.Description),
+			DefaultValue: m.getDefaultValue(field.DefaultValue, fieldType),
+		}
 	}
+
+	m.inputFields[schemaType.Name] = fields
+
+	return nil
 }
 
-func (m *MergedSchemas) getSourceBodyFromSelection(selection ast.Selection, parentTypename string) string {
+func (m *serviceQuery) getSourceBodyFromSelection(selection ast.Selection, parentTypename string) string {
 	switch selection.(type) {
 	case *ast.Field:
 		field := selection.(*ast.Field)
@@ -120,18 +421,40 @@ func (m *MergedSchemas) getSourceBodyFromSelection(selection ast.Selection, pare
 				return ""
 			}
 		}
-		fieldType := m.types[parentTypename].Fields()[field.Name.Value]
-		return m.getSourceBodyFromField(selection.(*ast.Field), getOutputTypeName(fieldType.Type))
+		if field.Name.Value == "__typename" {
+			return "__typename" + getDirectivesString(field.Directives)
+		}
+		if !m.checkField(parentTypename, field.Name.Value) {
+			return ""
+		}
+		return m.getSourceBodyFromField(field, parentTypename)
 	case *ast.FragmentSpread:
 		fragmentSpread := selection.(*ast.FragmentSpread)
-		return "..." + fragmentSpread.Name.Value
+		return "..." + fragmentSpread.Name.Value + getDirectivesString(fragmentSpread.Directives)
+	case *ast.InlineFragment:
+		inlineFragment := selection.(*ast.InlineFragment)
+		return m.getSourceBodyFromInlineFragment(inlineFragment, parentTypename)
 	default:
 		fmt.Printf("Unknown selection type: %+v\n", selection)
 		return ""
 	}
 }
 
-func (m *MergedSchemas) getSourceBodyFromSelectionSet(selectionSet *ast.SelectionSet, parentTypename string) string {
+func (m *serviceQuery) getSourceBodyFromInlineFragment(inlineFragment *ast.InlineFragment, parentTypename string) string {
+	resultString := "..."
+
+	typename := parentTypename
+	if inlineFragment.TypeCondition != nil {
+		typename = inlineFragment.TypeCondition.Name.Value
+		resultString += " on " + m.getOriginalTypeName(typename)
+	}
+
+	resultString += getDirectivesString(inlineFragment.Directives)
+
+	return resultString + "{" + m.getSourceBodyFromSelectionSet(inlineFragment.SelectionSet, typename) + "}"
+}
+
+func (m *serviceQuery) getSourceBodyFromSelectionSet(selectionSet *ast.SelectionSet, parentTypename string) string {
 	results := make([]string, 0)
 
 	for _, selection := range selectionSet.Selections {
@@ -147,12 +470,15 @@ func (m *MergedSchemas) getSourceBodyFromSelectionSet(selectionSet *ast.Selectio
 func getValueString(value ast.Value) string {
 	switch value.(type) {
 	case *ast.StringValue:
-		return "\"" + value.GetValue().(string) + "\""
+		quoted, _ := json.Marshal(value.GetValue().(string))
+		return string(quoted)
 	case *ast.IntValue:
 		return value.GetValue().(string)
 	case *ast.FloatValue:
 		return value.GetValue().(string)
 	case *ast.BooleanValue:
+		return strconv.FormatBool(value.GetValue().(bool))
+	case *ast.EnumValue:
 		return value.GetValue().(string)
 	case *ast.Variable:
 		return "$" + value.GetValue().(*ast.Name).Value
@@ -184,25 +510,115 @@ func getObjectFieldString(argument *ast.ObjectField) string {
 	return argument.Name.Value + ": " + getValueString(argument.Value)
 }
 
-func getArgumentString(argument *ast.Argument) string {
+// literals of scalars the gateway parses itself have to be serialized again in the format of the service
+func getTypedValueString(value ast.Value, valueType graphql.Input) string {
+	if _, isVariable := value.(*ast.Variable); isVariable {
+		return getValueString(value)
+	}
+
+	switch valueType := valueType.(type) {
+	case *graphql.NonNull:
+		return getTypedValueString(value, valueType.OfType)
+	case *graphql.List:
+		listValue, ok := value.(*ast.ListValue)
+		if !ok {
+			return getTypedValueString(value, valueType.OfType)
+		}
+
+		fieldStrings := make([]string, 0)
+		for _, field := range listValue.Values {
+			fieldStrings = append(fieldStrings, getTypedValueString(field, valueType.OfType))
+		}
+
+		return "[" + strings.Join(fieldStrings, ",") + "]"
+	case *graphql.InputObject:
+		objectValue, ok := value.(*ast.ObjectValue)
+		if !ok {
+			return getValueString(value)
+		}
+
+		fieldStrings := make([]string, 0)
+		for _, field := range objectValue.Fields {
+			inputField := valueType.Fields()[field.Name.Value]
+			if inputField == nil {
+				fieldStrings = append(fieldStrings, getObjectFieldString(field))
+			} else {
+				fieldStrings = append(fieldStrings, field.Name.Value+": "+getTypedValueString(field.Value, inputField.Type))
+			}
+		}
+
+		return "{" + strings.Join(fieldStrings, ",") + "}"
+	case *graphql.Scalar:
+		if valueType == dataScalar {
+			if serialized, ok := serializeDate(dataScalar.ParseLiteral(value)).(string); ok {
+				quoted, _ := json.Marshal(serialized)
+				return string(quoted)
+			}
+		}
+
+		return getValueString(value)
+	default:
+		return getValueString(value)
+	}
+}
+
+func getDirectivesString(directives []*ast.Directive) string {
+	resultString := ""
+
+	for _, directive := range directives {
+		resultString += " @" + directive.Name.Value
+
+		argumentList := make([]string, 0)
+		for _, argument := range directive.Arguments {
+			argumentList = append(argumentList, getArgumentString(argument, nil))
+		}
+
+		if len(argumentList) > 0 {
+			resultString += "(" + strings.Join(argumentList, ",") + ")"
+		}
+	}
+
+	return resultString
+}
+
+func getArgumentString(argument *ast.Argument, args []*graphql.Argument) string {
+	for _, arg := range args {
+		if arg.Name() == argument.Name.Value {
+			return argument.Name.Value + ": " + getTypedValueString(argument.Value, arg.Type)
+		}
+	}
+
 	return argument.Name.Value + ": " + getValueString(argument.Value)
 }
 
-func (m *MergedSchemas) getSourceBodyFromField(field *ast.Field, returnType string) string {
+func (m *serviceQuery) getSourceBodyFromField(field *ast.Field, parentTypename string) string {
+	fieldDefinition := m.getFieldDefinition(parentTypename, field.Name.Value)
+	if fieldDefinition == nil {
+		fmt.Printf("Unknown field %v on type %v\n", field.Name.Value, parentTypename)
+		return ""
+	}
+	returnType := getOutputTypeName(fieldDefinition.Type)
+
 	resultString := ""
-	resultString += field.Name.Value
+	resultString += m.getOriginalFieldName(parentTypename, field.Name.Value)
 
 	argumentList := make([]string, 0)
 	for _, argument := range field.Arguments {
-		argumentList = append(argumentList, getArgumentString(argument))
+		argumentList = append(argumentList, getArgumentString(argument, fieldDefinition.Args))
 	}
 
 	if len(argumentList) > 0 {
 		resultString += "(" + strings.Join(argumentList, ",") + ")"
 	}
 
+	resultString += getDirectivesString(field.Directives)
+
 	if field.SelectionSet != nil {
-		resultString += "{" + m.getSourceBodyFromSelectionSet(field.SelectionSet, returnType) + "}"
+		selectionBody := m.getSourceBodyFromSelectionSet(field.SelectionSet, returnType)
+		if m.isAbstractType(returnType) {
+			selectionBody = "__typename " + selectionBody
+		}
+		resultString += "{" + selectionBody + "}"
 	}
 	return resultString
 }
@@ -213,28 +629,32 @@ func getOutputTypeName(output graphql.Output) string {
 		return output.(*graphql.Scalar).Name()
 	case *graphql.Object:
 		return output.(*graphql.Object).Name()
-	//case *graphql.Interface:
-	//case *graphql.Union:
-	//case *graphql.Enum:
+	case *graphql.Interface:
+		return output.(*graphql.Interface).Name()
+	case *graphql.Union:
+		return output.(*graphql.Union).Name()
+	case *graphql.Enum:
+		return output.(*graphql.Enum).Name()
 	case *graphql.List:
 		return getOutputTypeName(output.(*graphql.List).OfType)
 	case *graphql.NonNull:
 		return getOutputTypeName(output.(*graphql.NonNull).OfType)
 	default:
-		panic("Unsupported Outputtype " + fmt.Sprintf("%+v", reflect.TypeOf(output)))
+		fmt.Printf("Unsupported Outputtype %+v\n", reflect.TypeOf(output))
+		return ""
 	}
 }
 
-func (m *MergedSchemas) getSourceBody(p graphql.ResolveParams) string {
+func (m *serviceQuery) getSourceBody(p graphql.ResolveParams) string {
 	if len(p.Info.FieldASTs) > 0 {
-		return m.getSourceBodyFromField(p.Info.FieldASTs[0], getOutputTypeName(p.Info.ReturnType))
+		return m.getSourceBodyFromField(p.Info.FieldASTs[0], p.Info.ParentType.Name())
 	}
 
 	return ""
 }
 
 func setAuthHeaders(p *graphql.ResolveParams, request *http.Request) {
-	authValue := p.Context.Value("Authentication").(string)
+	authValue, _ := p.Context.Value("Authentication").(string)
 
 	if authValue != "" {
 		request.Header.Add("Authentication", authValue)
@@ -247,19 +667,34 @@ func setJSONHeaders(request *http.Request) {
 	request.Header.Add("Content-Type", "application/json")
 }
 
-func getQueryArgs(p graphql.ResolveParams) string {
-	variableDefs := p.Info.Operation.GetVariableDefinitions()
+func (m *serviceQuery) getTypeString(astType ast.Type) string {
+	switch astType := astType.(type) {
+	case *ast.NonNull:
+		return m.getTypeString(astType.Type) + "!"
+	case *ast.List:
+		return "[" + m.getTypeString(astType.Type) + "]"
+	case *ast.Named:
+		return m.getOriginalTypeName(astType.Name.Value)
+	default:
+		return ""
+	}
+}
 
-	argUsage := make(map[string]bool)
+func (m *serviceQuery) getVariableDefinitionString(varDef *ast.VariableDefinition) string {
+	resultString := "$" + varDef.Variable.Name.Value + ": " + m.getTypeString(varDef.Type)
 
-	for _, field := range p.Info.FieldASTs {
-		for _, argument := range field.Arguments {
-			if argument.Value.GetKind() == "Variable" {
-				argUsage[argument.Value.GetValue().(*ast.Name).Value] = true
-			}
-		}
+	if varDef.DefaultValue != nil {
+		resultString += " = " + getValueString(varDef.DefaultValue)
 	}
 
+	return resultString
+}
+
+func (m *serviceQuery) getQueryArgs(p graphql.ResolveParams, checker *FragmentChecker) string {
+	variableDefs := p.Info.Operation.GetVariableDefinitions()
+
+	argUsage := checker.UsedVariables
+
 	if len(variableDefs) > 0 {
 		varStrings := make([]string, 0)
 		for i := range variableDefs {
@@ -267,7 +702,7 @@ func getQueryArgs(p graphql.ResolveParams) string {
 			varName := varDef.Variable.Name.Value
 
 			if argUsage[varName] {
-				varStrings = append(varStrings, string(varDef.Loc.Source.Body)[varDef.Loc.Start:varDef.Loc.End])
+				varStrings = append(varStrings, m.getVariableDefinitionString(varDef))
 			}
 		}
 
@@ -281,25 +716,37 @@ func getQueryArgs(p graphql.ResolveParams) string {
 	return ""
 }
 
-func getFragments(p graphql.ResolveParams) string {
-	fragments := ""
+// fragments are rebuilt instead of copied, so their type conditions and fields are translated like the query
+func (m *serviceQuery) getFragmentString(fragment *ast.FragmentDefinition) string {
+	typename := fragment.TypeCondition.Name.Value
 
-	checker := &FragmentChecker{
-		Fragments:     p.Info.Fragments,
-		UsedFragments: make(map[string]bool),
-	}
-	checker.MarkFields(p)
+	return "fragment " + fragment.Name.Value + " on " + m.getOriginalTypeName(typename) +
+		getDirectivesString(fragment.Directives) +
+		"{" + m.getSourceBodyFromSelectionSet(fragment.SelectionSet, typename) + "}"
+}
+
+func (m *serviceQuery) getFragments(p graphql.ResolveParams, checker *FragmentChecker) string {
+	fragments := ""
 
 	for fragmentName := range p.Info.Fragments {
 		if checker.UsedFragments[fragmentName] {
-			loc := p.Info.Fragments[fragmentName].GetLoc()
-			fragments += string(loc.Source.Body[loc.Start:loc.End])
+			if fragment, ok := p.Info.Fragments[fragmentName].(*ast.FragmentDefinition); ok {
+				fragments += " " + m.getFragmentString(fragment)
+			}
 		}
 	}
 
 	return fragments
 }
 
+func getContext(p graphql.ResolveParams) context.Context {
+	if p.Context == nil {
+		return context.Background()
+	}
+
+	return p.Context
+}
+
 func performRequest(serviceInfo eventbus.ServiceInfo, p graphql.ResolveParams, query string) (*http.Response, error) {
 	jsonValue, _ := json.Marshal(dukGraphql.Request{
 		Query:     query,
@@ -309,8 +756,10 @@ func performRequest(serviceInfo eventbus.ServiceInfo, p graphql.ResolveParams, q
 	client := &http.Client{}
 	request, err := http.NewRequest("POST", "http://"+serviceInfo.Hostname+":"+serviceInfo.Port+serviceInfo.GraphQLHttpEndpoint, bytes.NewBuffer(jsonValue))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	//a stopped operation cancels its requests to the services
+	request = request.WithContext(getContext(p))
 
 	setAuthHeaders(&p, request)
 	setJSONHeaders(request)
@@ -318,21 +767,48 @@ func performRequest(serviceInfo eventbus.ServiceInfo, p graphql.ResolveParams, q
 	return client.Do(request)
 }
 
-func handleRequestResult(p graphql.ResolveParams, resp *http.Response, err error) (interface{}, error) {
+func (m *schemaBuild) handleRequestResult(serviceInfo eventbus.ServiceInfo, fieldName string, resp *http.Response, err error) (interface{}, error) {
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("Request to service %v failed: %v", serviceInfo.Name, err)
 	}
 
 	defer resp.Body.Close()
 	var result map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&result)
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("Invalid response from service %v: %v", serviceInfo.Name, err)
+	}
 
 	if result["errors"] != nil {
 		errorString, _ := json.Marshal(result["errors"])
 		return nil, errors.New(string(errorString))
 	}
 
-	return result["data"].(map[string]interface{})[p.Info.FieldName], nil
+	data, ok := result["data"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Response from service %v contains no data", serviceInfo.Name)
+	}
+
+	return m.getServiceResult(serviceInfo, data[fieldName]), nil
+}
+
+// request sends the query to one instance of the service, an instance that cannot be reached is left out of the rotation for a while.
+// Requests cancelled by their context say nothing about the instance
+func (m *schemaBuild) request(serviceInfo eventbus.ServiceInfo, p graphql.ResolveParams, query string, fieldName string) (interface{}, error) {
+	pool := m.pools[serviceInfo.Name]
+	if pool == nil {
+		return nil, errors.New("No instance of service " + serviceInfo.Name + " available")
+	}
+
+	instance, instanceInfo := pool.acquire()
+	if instance == nil {
+		return nil, errors.New("No instance of service " + serviceInfo.Name + " available")
+	}
+
+	resp, err := performRequest(instanceInfo, p, query)
+	result, resultErr := m.handleRequestResult(serviceInfo, fieldName, resp, err)
+	pool.release(instance, err != nil && getContext(p).Err() == nil)
+
+	return result, resultErr
 }
 
 type ThunkResultType struct {
@@ -347,37 +823,49 @@ func createThunkResolver(ch chan *ThunkResultType) func() (interface{}, error) {
 	}
 }
 
-func (m *MergedSchemas) createQueryResolver(serviceInfo eventbus.ServiceInfo) func(graphql.ResolveParams) (interface{}, error) {
+func (m *schemaBuild) createQueryResolver(serviceInfo eventbus.ServiceInfo) func(graphql.ResolveParams) (interface{}, error) {
 	return func(p graphql.ResolveParams) (interface{}, error) {
 		ch := make(chan *ThunkResultType, 1)
 		go func() {
 			defer close(ch)
 
-			query := "query" + getQueryArgs(p) + " {" + m.getSourceBody(p) + "}" + getFragments(p)
+			checker := NewFragmentChecker(p.Info.Fragments)
+			checker.MarkFields(p)
 
-			resp, err := performRequest(serviceInfo, p, query)
+			serviceQuery := m.newServiceQuery(serviceInfo.Name)
+			query := "query" + serviceQuery.getQueryArgs(p, checker) + " {" + serviceQuery.getSourceBody(p) + "}" + serviceQuery.getFragments(p, checker)
+			if err := serviceQuery.err(); err != nil {
+				ch <- &ThunkResultType{err: err}
+				return
+			}
 
-			result, err := handleRequestResult(p, resp, err)
+			result, err := m.request(serviceInfo, p, query, m.getOriginalFieldName(serviceInfo.Name, p.Info.ParentType.Name(), p.Info.FieldName))
 			ch <- &ThunkResultType{data: result, err: err}
 		}()
 		return createThunkResolver(ch), nil
 	}
 }
 
-func (m *MergedSchemas) createExtensionQueryResolver(serviceInfo eventbus.ServiceInfo, field eventbus.FieldType) func(graphql.ResolveParams) (interface{}, error) {
+func (m *schemaBuild) createExtensionQueryResolver(serviceInfo eventbus.ServiceInfo, field eventbus.FieldType) func(graphql.ResolveParams) (interface{}, error) {
 	return func(p graphql.ResolveParams) (interface{}, error) {
 		ch := make(chan *ThunkResultType, 1)
 		go func() {
 			defer close(ch)
 
-			query := "query {"
+			checker := NewFragmentChecker(p.Info.Fragments)
+			if p.Info.FieldASTs[0].SelectionSet != nil {
+				checker.MarkSelectionSet(p.Info.FieldASTs[0].SelectionSet)
+			}
+
+			serviceQuery := m.newServiceQuery(serviceInfo.Name)
+			query := "query" + serviceQuery.getQueryArgs(p, checker) + " {"
 
 			query += field.Resolve.By
 
 			if len(field.Resolve.FieldArguments) > 0 {
 				arguments := make([]string, 0)
 
-				source := p.Source.(map[string]interface{})
+				source, _ := p.Source.(map[string]interface{})
 
 				for argument, resolveBy := range field.Resolve.FieldArguments {
 					arguments = append(arguments, fmt.Sprintf("%v:%#v", argument, source[resolveBy]))
@@ -387,92 +875,201 @@ func (m *MergedSchemas) createExtensionQueryResolver(serviceInfo eventbus.Servic
 			}
 
 			if p.Info.FieldASTs[0].SelectionSet != nil {
-				query += "{" + m.getSourceBodyFromSelectionSet(p.Info.FieldASTs[0].SelectionSet, field.Type) + "}"
+				query += "{" + serviceQuery.getSourceBodyFromSelectionSet(p.Info.FieldASTs[0].SelectionSet, field.Type) + "}"
 			}
 
-			query += "}"
-
-			resp, err := performRequest(serviceInfo, p, query)
+			query += "}" + serviceQuery.getFragments(p, checker)
+			if err := serviceQuery.err(); err != nil {
+				ch <- &ThunkResultType{err: err}
+				return
+			}
 
-			result, err := handleRequestResult(p, resp, err)
+			result, err := m.request(serviceInfo, p, query, field.Resolve.By)
 			ch <- &ThunkResultType{data: result, err: err}
 		}()
 		return createThunkResolver(ch), nil
 	}
 }
 
-func (m *MergedSchemas) createMutationResolver(serviceInfo eventbus.ServiceInfo) func(graphql.ResolveParams) (interface{}, error) {
+func (m *schemaBuild) createMutationResolver(serviceInfo eventbus.ServiceInfo) func(graphql.ResolveParams) (interface{}, error) {
 	return func(p graphql.ResolveParams) (interface{}, error) {
-		mutation := "mutation " + getQueryArgs(p) + "{" + m.getSourceBody(p) + "}" + getFragments(p)
+		checker := NewFragmentChecker(p.Info.Fragments)
+		checker.MarkFields(p)
 
-		resp, err := performRequest(serviceInfo, p, mutation)
+		serviceQuery := m.newServiceQuery(serviceInfo.Name)
+		mutation := "mutation " + serviceQuery.getQueryArgs(p, checker) + "{" + serviceQuery.getSourceBody(p) + "}" + serviceQuery.getFragments(p, checker)
+		if err := serviceQuery.err(); err != nil {
+			return nil, err
+		}
 
-		return handleRequestResult(p, resp, err)
+		return m.request(serviceInfo, p, mutation, m.getOriginalFieldName(serviceInfo.Name, p.Info.ParentType.Name(), p.Info.FieldName))
 	}
 }
 
-func (m *MergedSchemas) getFieldArgs(args []FieldArg) graphql.FieldConfigArgument {
+func (m *schemaBuild) getFieldArgs(args []FieldArg) (graphql.FieldConfigArgument, error) {
 	result := graphql.FieldConfigArgument{}
 
 	for i := range args {
 		arg := args[i]
 
+		argType, err := m.getTypeDefinition(&arg.Type)
+		if err != nil {
+			return nil, errors.New("argument " + arg.Name + ": " + err.Error())
+		}
+
 		result[arg.Name] = &graphql.ArgumentConfig{
-			Type: m.getTypeDefinition(&arg.Type),
+			Type:         argType,
+			Description:  getDescription(arg.Description),
+			DefaultValue: m.getDefaultValue(arg.DefaultValue, argType),
 		}
 	}
 
-	return result
+	return result, nil
 }
 
-func (m *MergedSchemas) scanTypeFields(typeList []Type, serviceInfo eventbus.ServiceInfo) {
-	for i := range typeList {
-		schemaType := typeList[i]
+func (m *schemaBuild) getField(field TypeField) (*graphql.Field, error) {
+	fieldType, err := m.getTypeDefinition(&field.Type)
+	if err != nil {
+		return nil, errors.New("field " + field.Name + ": " + err.Error())
+	}
 
-		if strings.HasPrefix(schemaType.Name, "__") {
-			continue
+	var fieldDefinition graphql.Field
+	fieldDefinition.Name = field.Name
+	fieldDefinition.Type = fieldType
+	fieldDefinition.Description = getDescription(field.Description)
+	fieldDefinition.DeprecationReason = getDeprecationReason(field.IsDeprecated, field.DeprecationReason)
+
+	if len(field.Args) > 0 {
+		fieldDefinition.Args, err = m.getFieldArgs(field.Args)
+		if err != nil {
+			return nil, errors.New("field " + field.Name + ": " + err.Error())
 		}
+	}
 
-		switch schemaType.Kind {
-		case "SCALAR":
-			continue
-		case "INPUT_OBJECT":
-			continue
-		case "INTERFACE":
-			continue
-		case "OBJECT":
-			object := m.types[schemaType.Name]
-
-			for fieldIndex := range schemaType.Fields {
-				field := schemaType.Fields[fieldIndex]
-
-				var fieldDefinition graphql.Field
-				fieldDefinition.Name = field.Name
-				fieldDefinition.Type = m.getTypeDefinition(&field.Type)
-				if schemaType.Name == "Query" {
-					fieldDefinition.Resolve = m.createQueryResolver(serviceInfo)
-				} else if schemaType.Name == "Mutation" {
-					fieldDefinition.Resolve = m.createMutationResolver(serviceInfo)
-				} else {
-					fieldDefinition.Resolve = func(p graphql.ResolveParams) (interface{}, error) {
-						result := p.Source.(map[string]interface{})[p.Info.FieldName]
-						return result, nil
-					}
-				}
+	return &fieldDefinition, nil
+}
 
-				if len(field.Args) > 0 {
-					fieldDefinition.Args = m.getFieldArgs(field.Args)
-				}
+func passthroughResolver(p graphql.ResolveParams) (interface{}, error) {
+	source, ok := p.Source.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	return source[p.Info.FieldName], nil
+}
+
+func (m *schemaBuild) scanTypeFields(schemaType Type, serviceInfo eventbus.ServiceInfo) error {
+	if strings.HasPrefix(schemaType.Name, "__") {
+		return nil
+	}
 
-				object.AddFieldConfig(field.Name, &fieldDefinition)
+	switch schemaType.Kind {
+	case "SCALAR":
+		return nil
+	case "INPUT_OBJECT":
+		return nil
+	case "UNION":
+		return nil
+	case "ENUM":
+		return nil
+	case "INTERFACE":
+		object := m.interfaces[schemaType.Name]
+
+		for fieldIndex := range schemaType.Fields {
+			field := schemaType.Fields[fieldIndex]
+
+			if !m.claimField(schemaType.Name, field, serviceInfo.Name) {
+				continue
+			}
+
+			fieldDefinition, err := m.getField(field)
+			if err != nil {
+				return err
 			}
-		default:
-			panic("Unknown kind " + schemaType.Kind)
+
+			object.AddFieldConfig(field.Name, fieldDefinition)
 		}
+	case "OBJECT":
+		object := m.types[schemaType.Name]
+
+		for fieldIndex := range schemaType.Fields {
+			field := schemaType.Fields[fieldIndex]
+
+			if !m.claimField(schemaType.Name, field, serviceInfo.Name) {
+				continue
+			}
+
+			fieldDefinition, err := m.getField(field)
+			if err != nil {
+				return err
+			}
+
+			if schemaType.Name == "Query" {
+				fieldDefinition.Resolve = m.createQueryResolver(serviceInfo)
+			} else if schemaType.Name == "Mutation" {
+				fieldDefinition.Resolve = m.createMutationResolver(serviceInfo)
+			} else {
+				fieldDefinition.Resolve = passthroughResolver
+			}
+
+			object.AddFieldConfig(field.Name, fieldDefinition)
+		}
+	default:
+		return errors.New("Unknown kind " + schemaType.Kind)
 	}
+
+	return nil
 }
 
-func (m *MergedSchemas) markExtensionField(typeName string, fieldName string) {
+func isSpecifiedDirective(name string) bool {
+	for _, directive := range graphql.SpecifiedDirectives {
+		if directive.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *schemaBuild) scanDirectives(remoteSchema RemoteSchema) error {
+	for _, directive := range remoteSchema.SchemaResponse.Data.Schema.Directives {
+		if isSpecifiedDirective(directive.Name) || m.directives[directive.Name] != nil {
+			continue
+		}
+
+		args, err := m.getFieldArgs(directive.Args)
+		if err != nil {
+			return newSchemaError(remoteSchema.ServiceInfo.Name, "@"+directive.Name, err)
+		}
+
+		m.directives[directive.Name] = graphql.NewDirective(graphql.DirectiveConfig{
+			Name:        directive.Name,
+			Description: getDescription(directive.Description),
+			Locations:   directive.Locations,
+			Args:        args,
+		})
+	}
+
+	return nil
+}
+
+// custom directives of the services are advertised next to the ones every schema has
+func (m *schemaBuild) getDirectives() []*graphql.Directive {
+	names := make([]string, 0)
+	for name := range m.directives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := append([]*graphql.Directive{}, graphql.SpecifiedDirectives...)
+	for _, name := range names {
+		result = append(result, m.directives[name])
+	}
+
+	return result
+}
+
+func (m *schemaBuild) markExtensionField(typeName string, fieldName string) {
 	t := m.typeExtensions[typeName]
 	if t == nil {
 		t = make(map[string]bool)
@@ -481,7 +1078,7 @@ func (m *MergedSchemas) markExtensionField(typeName string, fieldName string) {
 	t[fieldName] = true
 }
 
-func (m *MergedSchemas) scanTypeExtensionField(extendingType *graphql.Object, field eventbus.FieldType) {
+func (m *schemaBuild) scanTypeExtensionField(extendingType *graphql.Object, field eventbus.FieldType) {
 	targetType := m.types[field.Type]
 	if targetType == nil {
 		return
@@ -497,61 +1094,241 @@ func (m *MergedSchemas) scanTypeExtensionField(extendingType *graphql.Object, fi
 	m.markExtensionField(extendingType.Name(), field.Name)
 }
 
-func (m *MergedSchemas) scanTypeExtension(extension eventbus.SchemaExtension) {
-	extendingType := m.types[extension.Type]
+// scanTypeExtension adds the fields of an extension, its type names are the ones the service uses
+func (m *schemaBuild) scanTypeExtension(serviceInfo eventbus.ServiceInfo, extension eventbus.SchemaExtension) {
+	extendingType := m.types[m.getServiceTypeName(serviceInfo.Name, extension.Type)]
 
 	if extendingType == nil {
 		return
 	}
 
 	for _, field := range extension.Fields {
+		field.Type = m.getServiceTypeName(serviceInfo.Name, field.Type)
 		m.scanTypeExtensionField(extendingType, field)
 	}
 }
 
-func (m *MergedSchemas) scanTypeExtensions(serviceInfo eventbus.ServiceInfo) {
+func (m *schemaBuild) scanTypeExtensions(serviceInfo eventbus.ServiceInfo) {
 	for _, extension := range serviceInfo.SchemaExtensions {
-		m.scanTypeExtension(extension)
+		m.scanTypeExtension(serviceInfo, extension)
 	}
 }
 
-func (m *MergedSchemas) BuildSchema() (graphql.Schema, error) {
-	m.types = make(map[string]*graphql.Object)
-	m.inputTypes = make(map[string]*graphql.InputObject)
-	m.typeExtensions = make(map[string]map[string]bool)
-	m.serviceInfoByType = make(map[string]eventbus.ServiceInfo)
+// scanServices runs one step of the schema building over the owned types of every service
+func (m *schemaBuild) scanServices(remoteSchemas []RemoteSchema, ownedTypes map[string][]Type, scan func(Type, eventbus.ServiceInfo) error) error {
+	for _, remoteSchema := range remoteSchemas {
+		for _, schemaType := range ownedTypes[remoteSchema.ServiceInfo.Name] {
+			if err := scan(schemaType, remoteSchema.ServiceInfo); err != nil {
+				return newSchemaError(remoteSchema.ServiceInfo.Name, schemaType.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *schemaBuild) buildSchema(excludedServices map[string]bool) (graphql.Schema, error) {
+	remoteSchemas := make([]RemoteSchema, 0)
+	for _, remoteSchema := range m.getOrderedServiceSchemas() {
+		if excludedServices[remoteSchema.ServiceInfo.Name] {
+			continue
+		}
+
+		m.report.Services = append(m.report.Services, remoteSchema.ServiceInfo.Name)
+		m.pools[remoteSchema.ServiceInfo.Name] = m.MergedSchemas.pools[remoteSchema.ServiceInfo.Name]
+
+		if typeName, err := validateTypes(remoteSchema.SchemaResponse.Data.Schema.Types); err != nil {
+			return graphql.Schema{}, newSchemaError(remoteSchema.ServiceInfo.Name, typeName, err)
+		}
+
+		remoteSchema, err := m.renameRootTypes(remoteSchema)
+		if err != nil {
+			return graphql.Schema{}, newSchemaError(remoteSchema.ServiceInfo.Name, "", err)
+		}
+
+		remoteSchemas = append(remoteSchemas, m.applyNamespace(remoteSchema))
+	}
 
-	for i := range m.serviceSchemas {
-		remoteSchema := m.serviceSchemas[i]
-		m.scanTypes(remoteSchema.SchemaResponse.Data.Schema.Types, remoteSchema.ServiceInfo)
-		m.scanInputTypes(remoteSchema.SchemaResponse.Data.Schema.Types)
-		m.scanTypeFields(remoteSchema.SchemaResponse.Data.Schema.Types, remoteSchema.ServiceInfo)
+	m.scanTypeOwners(remoteSchemas)
+	if m.ConflictPolicy == ConflictPolicyFail {
+		if err := m.report.Error(); err != nil {
+			return graphql.Schema{}, err
+		}
 	}
 
-	for i := range m.serviceSchemas {
-		m.scanTypeExtensions(m.serviceSchemas[i].ServiceInfo)
+	ownedTypes := make(map[string][]Type)
+	for _, remoteSchema := range remoteSchemas {
+		ownedTypes[remoteSchema.ServiceInfo.Name] = m.getOwnedTypes(remoteSchema)
+	}
+
+	//every step runs for all services before the next one, so types can reference types of any service
+	scanSteps := []func(Type, eventbus.ServiceInfo) error{
+		m.scanType,
+		m.scanUnionType,
+		m.scanInputFieldTypes,
+		m.scanInputFields,
+		m.scanTypeFields,
+	}
+	for _, scan := range scanSteps {
+		if err := m.scanServices(remoteSchemas, ownedTypes, scan); err != nil {
+			return graphql.Schema{}, err
+		}
+	}
+
+	for _, remoteSchema := range remoteSchemas {
+		if err := m.scanDirectives(remoteSchema); err != nil {
+			return graphql.Schema{}, err
+		}
+	}
+
+	for _, remoteSchema := range remoteSchemas {
+		m.scanTypeExtensions(remoteSchema.ServiceInfo)
+	}
+
+	m.report.RootFields = m.getRootFieldOwners()
+	if m.RejectDuplicateRootFields {
+		if schemaErr := m.report.getRootFieldError(); schemaErr != nil {
+			return graphql.Schema{}, schemaErr
+		}
+	}
+
+	//objects only reachable through an interface have to be registered explicitly
+	schemaTypes := make([]graphql.Type, 0)
+	for _, object := range m.types {
+		schemaTypes = append(schemaTypes, object)
 	}
 
 	schemaConfig := graphql.SchemaConfig{
 		Query:        m.types["Query"],
 		Mutation:     m.types["Mutation"],
 		Subscription: m.types["Subscription"],
+		Types:        schemaTypes,
+		Directives:   m.getDirectives(),
 	}
 	schema, err := graphql.NewSchema(schemaConfig)
 
 	if err != nil {
-		fmt.Printf("Error creating schema: %v\n", err)
+		if !m.probe {
+			fmt.Printf("Error creating schema: %v\n", err)
+			if schemaErr := m.findFailingService(remoteSchemas, excludedServices, err); schemaErr != nil {
+				return graphql.Schema{}, schemaErr
+			}
+		}
 		return graphql.Schema{}, err
 	}
 
+	m.schema = schema
+
 	return schema, nil
 }
 
-func (m *MergedSchemas) monitorService(serviceInfo eventbus.ServiceInfo, schemaResponse Response) {
+// findFailingService blames the service without which the schema can be built, for errors graphql-go reports for the whole schema.
+// Services are left out from the lowest priority up, so of two services that cannot be merged the one with the lower priority is blamed
+func (m *schemaBuild) findFailingService(remoteSchemas []RemoteSchema, excludedServices map[string]bool, err error) *SchemaError {
+	if len(remoteSchemas) == 1 {
+		return newSchemaError(remoteSchemas[0].ServiceInfo.Name, "", err)
+	}
+
+	for i := len(remoteSchemas) - 1; i >= 0; i-- {
+		remoteSchema := remoteSchemas[i]
+		excluded := map[string]bool{remoteSchema.ServiceInfo.Name: true}
+		for name := range excludedServices {
+			excluded[name] = true
+		}
+
+		build := newSchemaBuild(m.MergedSchemas)
+		build.probe = true
+		if _, probeErr := build.buildSchema(excluded); probeErr == nil {
+			return newSchemaError(remoteSchema.ServiceInfo.Name, "", err)
+		}
+	}
+
+	return nil
+}
+
+// publish makes the report of a build visible and, if the build succeeded, swaps in its schema
+func (m *MergedSchemas) publish(build *schemaBuild, succeeded bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.report = build.report
+	if succeeded {
+		m.current = build
+	}
+}
+
+// Schema returns the last schema that was built successfully
+func (m *MergedSchemas) Schema() graphql.Schema {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.current == nil {
+		return graphql.Schema{}
+	}
+
+	return m.current.schema
+}
+
+// BuildSchema merges the schemas of all services, services whose schema cannot be merged are left out
+// and listed in the FailedServices of the report
+func (m *MergedSchemas) BuildSchema() (schema graphql.Schema, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Panic while building schema: %v\n", r)
+			schema = graphql.Schema{}
+			err = fmt.Errorf("Error building schema: %v", r)
+		}
+	}()
+
+	failedServices := make([]SchemaError, 0)
+	excludedServices := make(map[string]bool)
+
+	for {
+		build := newSchemaBuild(m)
+		schema, err = build.buildSchema(excludedServices)
+		build.report.FailedServices = failedServices
+
+		schemaErr, isSchemaErr := err.(*SchemaError)
+		if !isSchemaErr {
+			m.publish(build, err == nil)
+			return schema, err
+		}
+
+		failedServices = append(failedServices, *schemaErr)
+		excludedServices[schemaErr.Service] = true
+	}
+}
+
+// serviceMonitor keeps a socket open to a service instance and reports the instance as down once the socket is lost.
+// A stopped monitor closes its socket without reporting anything, so an instance that was removed is not taken down again
+type serviceMonitor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// monitorService starts a monitor for the instance, the socket is dialed by the monitor so a service that does not answer
+// holds up nothing else
+func (m *MergedSchemas) monitorService(serviceInfo eventbus.ServiceInfo) *serviceMonitor {
+	ctx, cancel := context.WithCancel(context.Background())
+	monitor := &serviceMonitor{
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go monitor.watch(serviceInfo, m.ServiceDown)
+
+	return monitor
+}
+
+func (s *serviceMonitor) watch(serviceInfo eventbus.ServiceInfo, serviceDown func(serviceInfo eventbus.ServiceInfo)) {
+	defer close(s.done)
+
 	var websocketUrl = "ws://" + serviceInfo.Hostname + ":" + serviceInfo.Port + serviceInfo.GraphQLSocketEndpoint
 	fmt.Println(websocketUrl)
 
-	c, _, err := websocket.DefaultDialer.Dial(websocketUrl, nil)
+	c, _, err := websocket.DefaultDialer.DialContext(s.ctx, websocketUrl, nil)
 
 	if err != nil {
 		fmt.Println("Error connection to socket of service")
@@ -563,33 +1340,139 @@ func (m *MergedSchemas) monitorService(serviceInfo eventbus.ServiceInfo, schemaR
 		fmt.Printf("Connection closed to service %s(%v)\n", serviceInfo.Name, code)
 		fmt.Println(text)
 
-		//todo remove service
 		return nil
 	})
 
+	//stopping the monitor closes the socket, which ends the read below
+	readDone := make(chan struct{})
+	defer close(readDone)
 	go func() {
-		defer c.Close()
+		select {
+		case <-s.ctx.Done():
+		case <-readDone:
+		}
+		c.Close()
+	}()
 
-		for {
-			msgType, msg, err := c.ReadMessage()
-			fmt.Printf("msg from %s(%v): %s\n", serviceInfo.Name, msgType, string(msg))
+	for {
+		msgType, msg, err := c.ReadMessage()
 
-			if err != nil {
-				return
+		if err != nil {
+			if s.ctx.Err() == nil {
+				serviceDown(serviceInfo)
 			}
+			return
 		}
-	}()
+
+		fmt.Printf("msg from %s(%v): %s\n", serviceInfo.Name, msgType, string(msg))
+	}
+}
+
+func (s *serviceMonitor) stop() {
+	s.cancel()
 }
 
-func (m *MergedSchemas) AddService(serviceInfo eventbus.ServiceInfo, schemaResponse Response) {
+// ended returns whether the monitor gave up, either because the socket could not be opened or because it was lost
+func (s *serviceMonitor) ended() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// AddService registers the schema of a service instance and returns whether the schema has to be built again,
+// if ServiceDown is set the socket of the instance is monitored as well
+func (m *MergedSchemas) AddService(serviceInfo eventbus.ServiceInfo, schemaResponse Response) bool {
 	if m.serviceSchemas == nil {
 		m.serviceSchemas = make(map[string]RemoteSchema)
+		m.pools = make(map[string]*instancePool)
 	}
 
+	fingerprint := getFingerprint(serviceInfo, schemaResponse)
+	previous, known := m.serviceSchemas[serviceInfo.Name]
+	changed := !known || previous.Fingerprint != fingerprint
+
 	m.serviceSchemas[serviceInfo.Name] = RemoteSchema{
 		ServiceInfo:    serviceInfo,
 		SchemaResponse: schemaResponse,
+		Fingerprint:    fingerprint,
+	}
+
+	if m.pools[serviceInfo.Name] == nil {
+		m.pools[serviceInfo.Name] = &instancePool{}
+	}
+	m.pools[serviceInfo.Name].add(serviceInfo, time.Now())
+
+	//a monitor that could not open its socket is started again with the next announcement of the instance
+	instanceKey := getInstanceKey(serviceInfo)
+	if m.ServiceDown != nil && serviceInfo.GraphQLSocketEndpoint != "" && (m.monitors[instanceKey] == nil || m.monitors[instanceKey].ended()) {
+		if m.monitors == nil {
+			m.monitors = make(map[string]*serviceMonitor)
+		}
+
+		m.monitors[instanceKey] = m.monitorService(serviceInfo)
 	}
 
-	//m.monitorService(serviceInfo, schemaResponse)
+	return changed
+}
+
+// RemoveService drops an instance of a service, or all of them if no hostname is given.
+// It returns whether the last instance is gone, the schema has to be built again then
+func (m *MergedSchemas) RemoveService(serviceInfo eventbus.ServiceInfo) bool {
+	pool := m.pools[serviceInfo.Name]
+	if pool == nil {
+		return false
+	}
+
+	for _, instanceInfo := range pool.serviceInfos() {
+		if serviceInfo.Hostname != "" && getInstanceKey(instanceInfo) != getInstanceKey(serviceInfo) {
+			continue
+		}
+
+		pool.remove(instanceInfo)
+
+		instanceKey := getInstanceKey(instanceInfo)
+		if monitor := m.monitors[instanceKey]; monitor != nil {
+			delete(m.monitors, instanceKey)
+			monitor.stop()
+		}
+	}
+
+	if pool.size() > 0 {
+		return false
+	}
+
+	delete(m.pools, serviceInfo.Name)
+	delete(m.serviceSchemas, serviceInfo.Name)
+
+	return true
+}
+
+// Services returns the info of all registered service instances, ordered like the services are merged
+func (m *MergedSchemas) Services() []eventbus.ServiceInfo {
+	result := make([]eventbus.ServiceInfo, 0)
+	for _, remoteSchema := range m.getOrderedServiceSchemas() {
+		result = append(result, m.pools[remoteSchema.ServiceInfo.Name].serviceInfos()...)
+	}
+
+	return result
+}
+
+// MarkServiceSeen renews the lease of a service instance that answered a heartbeat
+func (m *MergedSchemas) MarkServiceSeen(serviceInfo eventbus.ServiceInfo, seen time.Time) {
+	if pool := m.pools[serviceInfo.Name]; pool != nil {
+		pool.markSeen(serviceInfo, seen)
+	}
+}
+
+// ExpiredServices returns the service instances that were last seen before the deadline
+func (m *MergedSchemas) ExpiredServices(deadline time.Time) []eventbus.ServiceInfo {
+	result := make([]eventbus.ServiceInfo, 0)
+	for _, remoteSchema := range m.getOrderedServiceSchemas() {
+		result = append(result, m.pools[remoteSchema.ServiceInfo.Name].expired(deadline)...)
+	}
+
+	return result
 }
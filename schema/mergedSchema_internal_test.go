@@ -1,11 +1,26 @@
 package schema
 
 import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/dukfaar/goUtils/eventbus"
+	dukGraphql "github.com/dukfaar/goUtils/graphql"
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
 )
 
 func BenchmarkMarkExtensionField(b *testing.B) {
-	mergedSchema := &MergedSchemas{}
+	mergedSchema := &schemaBuild{}
 	mergedSchema.typeExtensions = make(map[string]map[string]bool)
 	for i := 0; i < b.N; i++ {
 		mergedSchema.markExtensionField("testType", "testField")
@@ -13,7 +28,7 @@ func BenchmarkMarkExtensionField(b *testing.B) {
 }
 
 func TestMarkExtensionField(t *testing.T) {
-	mergedSchema := &MergedSchemas{}
+	mergedSchema := &schemaBuild{}
 	mergedSchema.typeExtensions = make(map[string]map[string]bool)
 	mergedSchema.markExtensionField("testType", "testField")
 	mergedSchema.markExtensionField("testType", "testField5")
@@ -33,3 +48,1015 @@ func TestMarkExtensionField(t *testing.T) {
 		t.Error("field is not correctly set as extend")
 	}
 }
+
+type recordingService struct {
+	server  *httptest.Server
+	queries []string
+}
+
+func newRecordingService(response string) *recordingService {
+	service := &recordingService{}
+	service.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request dukGraphql.Request
+		json.NewDecoder(r.Body).Decode(&request)
+		service.queries = append(service.queries, request.Query)
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write([]byte(response))
+	}))
+	return service
+}
+
+func (s *recordingService) serviceInfo(name string) eventbus.ServiceInfo {
+	serviceURL, _ := url.Parse(s.server.URL)
+	return eventbus.ServiceInfo{
+		Name:                name,
+		Hostname:            serviceURL.Hostname(),
+		Port:                serviceURL.Port(),
+		GraphQLHttpEndpoint: "/graphql",
+	}
+}
+
+func parseSchemaResponse(t *testing.T, schemaJSON string) Response {
+	var response Response
+	if err := json.Unmarshal([]byte(schemaJSON), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func executeQuery(schema graphql.Schema, query string) *graphql.Result {
+	return graphql.Do(graphql.Params{
+		Schema:        schema,
+		RequestString: query,
+		Context:       context.WithValue(context.Background(), "Authentication", ""),
+	})
+}
+
+const interfaceSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[
+		{"kind":"OBJECT","name":"Query","fields":[
+			{"name":"node","args":[],"type":{"kind":"INTERFACE","name":"Node"}}
+		]},
+		{"kind":"INTERFACE","name":"Node","fields":[
+			{"name":"id","args":[],"type":{"kind":"NON_NULL","ofType":{"kind":"SCALAR","name":"ID"}}}
+		],"possibleTypes":[{"kind":"OBJECT","name":"User"}]},
+		{"kind":"OBJECT","name":"User","fields":[
+			{"name":"id","args":[],"type":{"kind":"NON_NULL","ofType":{"kind":"SCALAR","name":"ID"}}},
+			{"name":"name","args":[],"type":{"kind":"SCALAR","name":"String"}}
+		],"interfaces":[{"kind":"INTERFACE","name":"Node"}]},
+		{"kind":"SCALAR","name":"ID"},
+		{"kind":"SCALAR","name":"String"}
+	]
+}}}`
+
+func TestInterfaceFieldIsForwardedWithInlineFragments(t *testing.T) {
+	service := newRecordingService(`{"data":{"node":{"__typename":"User","id":"1","name":"Alice"}}}`)
+	defer service.server.Close()
+
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(service.serviceInfo("users"), parseSchemaResponse(t, interfaceSchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := executeQuery(schema, `{ node { id ... on User { name } } }`)
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+
+	node := result.Data.(map[string]interface{})["node"].(map[string]interface{})
+	if node["name"] != "Alice" {
+		t.Errorf("unexpected result %+v", node)
+	}
+
+	if len(service.queries) != 1 {
+		t.Fatalf("expected one forwarded query, got %v", len(service.queries))
+	}
+	if !strings.Contains(service.queries[0], "__typename") {
+		t.Errorf("forwarded query does not request __typename: %v", service.queries[0])
+	}
+	if !strings.Contains(service.queries[0], "... on User{name}") {
+		t.Errorf("forwarded query lost the inline fragment: %v", service.queries[0])
+	}
+}
+
+const unionSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[
+		{"kind":"OBJECT","name":"Query","fields":[
+			{"name":"search","args":[],"type":{"kind":"LIST","ofType":{"kind":"UNION","name":"SearchResult"}}}
+		]},
+		{"kind":"UNION","name":"SearchResult","possibleTypes":[
+			{"kind":"OBJECT","name":"Book"},
+			{"kind":"OBJECT","name":"Author"}
+		]},
+		{"kind":"OBJECT","name":"Book","fields":[
+			{"name":"title","args":[],"type":{"kind":"SCALAR","name":"String"}}
+		]},
+		{"kind":"OBJECT","name":"Author","fields":[
+			{"name":"name","args":[],"type":{"kind":"SCALAR","name":"String"}}
+		]},
+		{"kind":"SCALAR","name":"String"}
+	]
+}}}`
+
+func TestUnionFieldIsForwardedWithInlineFragments(t *testing.T) {
+	service := newRecordingService(`{"data":{"search":[{"__typename":"Book","title":"Dune"},{"__typename":"Author","name":"Herbert"}]}}`)
+	defer service.server.Close()
+
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(service.serviceInfo("library"), parseSchemaResponse(t, unionSchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := executeQuery(schema, `{ search { __typename ... on Book { title } ... on Author { name } } }`)
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+
+	search := result.Data.(map[string]interface{})["search"].([]interface{})
+	if search[0].(map[string]interface{})["title"] != "Dune" || search[1].(map[string]interface{})["name"] != "Herbert" {
+		t.Errorf("unexpected result %+v", search)
+	}
+
+	if !strings.Contains(service.queries[0], "... on Book{title} ... on Author{name}") {
+		t.Errorf("forwarded query lost the inline fragments: %v", service.queries[0])
+	}
+}
+
+const enumSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[
+		{"kind":"OBJECT","name":"Query","fields":[
+			{"name":"paint","args":[
+				{"name":"color","type":{"kind":"NON_NULL","ofType":{"kind":"ENUM","name":"Color"}}}
+			],"type":{"kind":"ENUM","name":"Color"}}
+		]},
+		{"kind":"ENUM","name":"Color","enumValues":[
+			{"name":"RED","isDeprecated":false},
+			{"name":"BLUE","isDeprecated":true,"deprecationReason":"use RED"}
+		]}
+	]
+}}}`
+
+func TestEnumArgumentsAndResultsArePassedThrough(t *testing.T) {
+	service := newRecordingService(`{"data":{"paint":"RED"}}`)
+	defer service.server.Close()
+
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(service.serviceInfo("paint"), parseSchemaResponse(t, enumSchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := executeQuery(schema, `{ paint(color: RED) }`)
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+
+	if result.Data.(map[string]interface{})["paint"] != "RED" {
+		t.Errorf("unexpected result %+v", result.Data)
+	}
+	if !strings.Contains(service.queries[0], "paint(color: RED)") {
+		t.Errorf("forwarded query lost the enum argument: %v", service.queries[0])
+	}
+
+	for _, value := range mergedSchema.current.enums["Color"].Values() {
+		if value.Name == "BLUE" && value.DeprecationReason != "use RED" {
+			t.Errorf("deprecation reason not merged: %+v", value)
+		}
+	}
+}
+
+const customScalarSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[
+		{"kind":"OBJECT","name":"Query","fields":[
+			{"name":"settings","args":[
+				{"name":"filter","type":{"kind":"SCALAR","name":"JSON"}}
+			],"type":{"kind":"SCALAR","name":"JSON"}},
+			{"name":"count","args":[],"type":{"kind":"SCALAR","name":"Long"}}
+		]},
+		{"kind":"SCALAR","name":"JSON"},
+		{"kind":"SCALAR","name":"Long"}
+	]
+}}}`
+
+func TestUnknownScalarsArePassedThrough(t *testing.T) {
+	service := newRecordingService(`{"data":{"settings":{"theme":"dark","sizes":[1,2]}}}`)
+	defer service.server.Close()
+
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(service.serviceInfo("settings"), parseSchemaResponse(t, customScalarSchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mergedSchema.current.scalars["JSON"] == nil || mergedSchema.current.scalars["Long"] == nil {
+		t.Fatal("custom scalars were not registered")
+	}
+
+	result := executeQuery(schema, `{ settings(filter: {user: "me", ids: [1, 2.5, true]}) }`)
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+
+	settings := result.Data.(map[string]interface{})["settings"].(map[string]interface{})
+	if settings["theme"] != "dark" {
+		t.Errorf("unexpected result %+v", settings)
+	}
+	if !strings.Contains(service.queries[0], `settings(filter: {user: "me",ids: [1,2.5,true]})`) {
+		t.Errorf("forwarded query lost the literal: %v", service.queries[0])
+	}
+}
+
+func TestParseLiteralValue(t *testing.T) {
+	scalar := NewPassthroughScalar("JSON")
+	value := scalar.ParseLiteral(&ast.ObjectValue{Fields: []*ast.ObjectField{
+		{Name: &ast.Name{Value: "count"}, Value: &ast.IntValue{Value: "3"}},
+		{Name: &ast.Name{Value: "tags"}, Value: &ast.ListValue{Values: []ast.Value{&ast.StringValue{Value: "a"}}}},
+	}}).(map[string]interface{})
+
+	if value["count"] != int64(3) {
+		t.Errorf("int literal not parsed: %#v", value["count"])
+	}
+	if value["tags"].([]interface{})[0] != "a" {
+		t.Errorf("list literal not parsed: %#v", value["tags"])
+	}
+}
+
+const dateSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[
+		{"kind":"OBJECT","name":"Query","fields":[
+			{"name":"eventsSince","args":[
+				{"name":"since","type":{"kind":"NON_NULL","ofType":{"kind":"SCALAR","name":"Date"}}}
+			],"type":{"kind":"SCALAR","name":"Int"}}
+		]},
+		{"kind":"SCALAR","name":"Date"},
+		{"kind":"SCALAR","name":"Int"}
+	]
+}}}`
+
+func TestDateLiteralsAreForwardedAsRFC3339(t *testing.T) {
+	service := newRecordingService(`{"data":{"eventsSince":3}}`)
+	defer service.server.Close()
+
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(service.serviceInfo("events"), parseSchemaResponse(t, dateSchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := executeQuery(schema, `{ eventsSince(since: 1500000000000) }`)
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+	if !strings.Contains(service.queries[0], `eventsSince(since: "2017-07-14T02:40:00Z")`) {
+		t.Errorf("epoch literal not reserialized: %v", service.queries[0])
+	}
+
+	result = executeQuery(schema, `{ eventsSince(since: "not a date") }`)
+	if len(result.Errors) == 0 {
+		t.Error("invalid date literal was accepted")
+	}
+}
+
+func TestDeserializeDate(t *testing.T) {
+	expected := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	if date := deserializeDate("2018-05-01T12:00:00Z"); date != expected {
+		t.Errorf("RFC3339 string not parsed: %v", date)
+	}
+	if date := deserializeDate(float64(expected.Unix() * 1000)); date != expected {
+		t.Errorf("epoch not parsed: %v", date)
+	}
+	if date := deserializeDate("yesterday"); date != nil {
+		t.Errorf("invalid date accepted: %v", date)
+	}
+}
+
+const describedSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[
+		{"kind":"OBJECT","name":"Query","fields":[
+			{"name":"user","description":"Looks up a user","args":[
+				{"name":"id","description":"The id of the user","type":{"kind":"SCALAR","name":"ID"}}
+			],"type":{"kind":"OBJECT","name":"User"}}
+		]},
+		{"kind":"OBJECT","name":"User","description":"A registered user","fields":[
+			{"name":"login","args":[],"type":{"kind":"SCALAR","name":"String"},
+				"isDeprecated":true,"deprecationReason":"use name"}
+		]}
+	]
+}}}`
+
+func TestDescriptionsAndDeprecationsAreMerged(t *testing.T) {
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(eventbus.ServiceInfo{Name: "users"}, parseSchemaResponse(t, describedSchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := schema.Type("User").(*graphql.Object)
+	if user.Description() != "A registered user" {
+		t.Errorf("type description lost: %v", user.Description())
+	}
+	if user.Fields()["login"].DeprecationReason != "use name" {
+		t.Errorf("deprecation reason lost: %v", user.Fields()["login"].DeprecationReason)
+	}
+
+	userField := schema.QueryType().Fields()["user"]
+	if userField.Description != "Looks up a user" {
+		t.Errorf("field description lost: %v", userField.Description)
+	}
+	if userField.Args[0].Description() != "The id of the user" {
+		t.Errorf("argument description lost: %v", userField.Args[0].Description())
+	}
+}
+
+const defaultValueSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[
+		{"kind":"OBJECT","name":"Query","fields":[
+			{"name":"users","args":[
+				{"name":"limit","defaultValue":"10","type":{"kind":"SCALAR","name":"Int"}},
+				{"name":"order","defaultValue":"ASC","type":{"kind":"ENUM","name":"Order"}},
+				{"name":"filter","defaultValue":"{active: true}","type":{"kind":"INPUT_OBJECT","name":"UserFilter"}}
+			],"type":{"kind":"SCALAR","name":"Int"}}
+		]},
+		{"kind":"ENUM","name":"Order","enumValues":[{"name":"ASC"},{"name":"DESC"}]},
+		{"kind":"INPUT_OBJECT","name":"UserFilter","inputFields":[
+			{"name":"active","type":{"kind":"SCALAR","name":"Boolean"}},
+			{"name":"roles","defaultValue":"[\"user\"]","type":{"kind":"LIST","ofType":{"kind":"SCALAR","name":"String"}}}
+		]}
+	]
+}}}`
+
+func TestDefaultValuesAreMerged(t *testing.T) {
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(eventbus.ServiceInfo{Name: "users"}, parseSchemaResponse(t, defaultValueSchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := make(map[string]interface{})
+	for _, arg := range schema.QueryType().Fields()["users"].Args {
+		defaults[arg.Name()] = arg.DefaultValue
+	}
+
+	if defaults["limit"] != 10 {
+		t.Errorf("int default not parsed: %#v", defaults["limit"])
+	}
+	if defaults["order"] != "ASC" {
+		t.Errorf("enum default not parsed: %#v", defaults["order"])
+	}
+	if defaults["filter"].(map[string]interface{})["active"] != true {
+		t.Errorf("input object default not parsed: %#v", defaults["filter"])
+	}
+
+	roles := mergedSchema.current.inputTypes["UserFilter"].Fields()["roles"].DefaultValue.([]interface{})
+	if len(roles) != 1 || roles[0] != "user" {
+		t.Errorf("input field default not parsed: %#v", roles)
+	}
+}
+
+const directiveSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[
+		{"kind":"OBJECT","name":"Query","fields":[
+			{"name":"user","args":[],"type":{"kind":"OBJECT","name":"User"}}
+		]},
+		{"kind":"OBJECT","name":"User","fields":[
+			{"name":"name","args":[],"type":{"kind":"SCALAR","name":"String"}},
+			{"name":"email","args":[],"type":{"kind":"SCALAR","name":"String"}}
+		]}
+	],
+	"directives":[
+		{"name":"include","locations":["FIELD"],"args":[{"name":"if","type":{"kind":"NON_NULL","ofType":{"kind":"SCALAR","name":"Boolean"}}}]},
+		{"name":"uppercase","description":"Uppercases the value","locations":["FIELD"],"args":[]}
+	]
+}}}`
+
+func TestDirectivesAreMergedAndForwarded(t *testing.T) {
+	service := newRecordingService(`{"data":{"user":{"name":"ALICE","email":"alice@example.com"}}}`)
+	defer service.server.Close()
+
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(service.serviceInfo("users"), parseSchemaResponse(t, directiveSchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if schema.Directive("uppercase") == nil {
+		t.Fatal("custom directive is not part of the merged schema")
+	}
+	if schema.Directive("include") != graphql.IncludeDirective {
+		t.Error("specified directive was replaced")
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         schema,
+		RequestString:  `query($withEmail: Boolean!) { user { name @uppercase email @include(if: $withEmail) } }`,
+		VariableValues: map[string]interface{}{"withEmail": true},
+		Context:        context.WithValue(context.Background(), "Authentication", ""),
+	})
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+
+	query := service.queries[0]
+	if !strings.Contains(query, "($withEmail: Boolean!)") {
+		t.Errorf("variable used by a directive is not declared: %v", query)
+	}
+	if !strings.Contains(query, "name @uppercase email @include(if: $withEmail)") {
+		t.Errorf("directives were not forwarded: %v", query)
+	}
+}
+
+const brokenSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[
+		{"kind":"OBJECT","name":"Query","fields":[
+			{"name":"broken","args":[],"type":{"kind":"OBJECT","name":"Broken"}}
+		]},
+		{"kind":"OBJECT","name":"Broken","fields":[
+			{"name":"missing","args":[],"type":{"kind":"OBJECT","name":"Missing"}}
+		]}
+	]
+}}}`
+
+func TestBrokenServiceIsLeftOut(t *testing.T) {
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(eventbus.ServiceInfo{Name: "broken"}, parseSchemaResponse(t, brokenSchemaJSON))
+	mergedSchema.AddService(eventbus.ServiceInfo{Name: "users"}, parseSchemaResponse(t, usersItemSchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if schema.QueryType().Fields()["item"] == nil || schema.QueryType().Fields()["broken"] != nil {
+		t.Errorf("unexpected query fields %+v", schema.QueryType().Fields())
+	}
+
+	failedServices := mergedSchema.Report().FailedServices
+	if len(failedServices) != 1 || failedServices[0].Service != "broken" || failedServices[0].Type != "Broken" {
+		t.Errorf("unexpected failed services %+v", failedServices)
+	}
+}
+
+func TestServicesGraphqlRefusesAreLeftOut(t *testing.T) {
+	invalidSchemas := map[string]struct {
+		schemaJSON string
+		typeName   string
+	}{
+		"badName": {`{"data":{"__schema":{"queryType":{"name":"Query"},"types":[
+			{"kind":"OBJECT","name":"Query","fields":[{"name":"bad-name","args":[],"type":{"kind":"SCALAR","name":"String"}}]}
+		]}}}`, "Query"},
+		"undefinedMember": {`{"data":{"__schema":{"queryType":{"name":"Query"},"types":[
+			{"kind":"OBJECT","name":"Query","fields":[{"name":"result","args":[],"type":{"kind":"UNION","name":"Result"}}]},
+			{"kind":"UNION","name":"Result","possibleTypes":[{"kind":"OBJECT","name":"Missing"}]}
+		]}}}`, "Result"},
+		"noFields": {`{"data":{"__schema":{"queryType":{"name":"Query"},"types":[
+			{"kind":"OBJECT","name":"Query","fields":[{"name":"empty","args":[],"type":{"kind":"OBJECT","name":"Empty"}}]},
+			{"kind":"OBJECT","name":"Empty","fields":[]}
+		]}}}`, ""},
+	}
+
+	for name, invalidSchema := range invalidSchemas {
+		mergedSchema := &MergedSchemas{}
+		mergedSchema.AddService(eventbus.ServiceInfo{Name: name}, parseSchemaResponse(t, invalidSchema.schemaJSON))
+		mergedSchema.AddService(eventbus.ServiceInfo{Name: "users"}, parseSchemaResponse(t, usersItemSchemaJSON))
+
+		schema, err := mergedSchema.BuildSchema()
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+
+		if schema.QueryType().Fields()["item"] == nil {
+			t.Errorf("%v: healthy service is missing", name)
+		}
+
+		failedServices := mergedSchema.Report().FailedServices
+		if len(failedServices) != 1 || failedServices[0].Service != name || failedServices[0].Type != invalidSchema.typeName {
+			t.Errorf("%v: unexpected failed services %+v", name, failedServices)
+		}
+	}
+}
+
+const namedImplementationSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[
+		{"kind":"OBJECT","name":"Query","fields":[
+			{"name":"a","args":[],"type":{"kind":"OBJECT","name":"A"}}
+		]},
+		{"kind":"INTERFACE","name":"Named","fields":[
+			{"name":"name","args":[],"type":{"kind":"SCALAR","name":"String"}}
+		],"possibleTypes":[{"kind":"OBJECT","name":"A"}]},
+		{"kind":"OBJECT","name":"A","fields":[
+			{"name":"name","args":[],"type":{"kind":"SCALAR","name":"String"}}
+		],"interfaces":[{"kind":"INTERFACE","name":"Named"}]},
+		{"kind":"SCALAR","name":"String"}
+	]
+}}}`
+
+const namedExtensionSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[
+		{"kind":"OBJECT","name":"Query","fields":[
+			{"name":"b","args":[],"type":{"kind":"INTERFACE","name":"Named"}}
+		]},
+		{"kind":"INTERFACE","name":"Named","fields":[
+			{"name":"name","args":[],"type":{"kind":"SCALAR","name":"String"}},
+			{"name":"title","args":[],"type":{"kind":"SCALAR","name":"String"}}
+		],"possibleTypes":[]},
+		{"kind":"SCALAR","name":"String"}
+	]
+}}}`
+
+func TestIncompatibleServicesBlameTheLowerPriority(t *testing.T) {
+	entries := []struct {
+		priorities map[string]int
+		failed     string
+	}{
+		{map[string]int{"a": 10, "b": 0}, "b"},
+		{map[string]int{"a": 0, "b": 10}, "a"},
+	}
+
+	for _, entry := range entries {
+		mergedSchema := &MergedSchemas{Priorities: entry.priorities}
+		mergedSchema.AddService(eventbus.ServiceInfo{Name: "a"}, parseSchemaResponse(t, namedImplementationSchemaJSON))
+		mergedSchema.AddService(eventbus.ServiceInfo{Name: "b"}, parseSchemaResponse(t, namedExtensionSchemaJSON))
+
+		if _, err := mergedSchema.BuildSchema(); err != nil {
+			t.Errorf("%v: %v", entry.priorities, err)
+			continue
+		}
+
+		failedServices := mergedSchema.Report().FailedServices
+		if len(failedServices) != 1 || failedServices[0].Service != entry.failed {
+			t.Errorf("%v: unexpected failed services %+v", entry.priorities, failedServices)
+		}
+	}
+}
+
+func TestResponseWithoutDataIsAnError(t *testing.T) {
+	service := newRecordingService(`{}`)
+	defer service.server.Close()
+
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(service.serviceInfo("users"), parseSchemaResponse(t, usersItemSchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := executeQuery(schema, `{ item { id } }`)
+	if len(result.Errors) == 0 {
+		t.Errorf("missing data was not reported: %+v", result)
+	}
+}
+
+func TestRemoveServiceReleasesItsFields(t *testing.T) {
+	mergedSchema := newConflictingSchemas(t, ConflictPolicyMerge)
+
+	if !mergedSchema.RemoveService(eventbus.ServiceInfo{Name: "users"}) {
+		t.Fatal("known service was not removed")
+	}
+	if mergedSchema.RemoveService(eventbus.ServiceInfo{Name: "users"}) {
+		t.Error("service was removed twice")
+	}
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if schema.QueryType().Fields()["item"] != nil || mergedSchema.current.types["Item"].Fields()["owner"] != nil {
+		t.Error("fields of the removed service are still part of the schema")
+	}
+	if owner, _ := mergedSchema.FieldOwner("Query", "items"); owner != "inventory" {
+		t.Errorf("Query.items owned by %v", owner)
+	}
+}
+
+func TestExpiredServices(t *testing.T) {
+	mergedSchema := newConflictingSchemas(t, ConflictPolicyMerge)
+
+	future := time.Now().Add(time.Hour)
+	mergedSchema.MarkServiceSeen(eventbus.ServiceInfo{Name: "users"}, future)
+	mergedSchema.MarkServiceSeen(eventbus.ServiceInfo{Name: "unknown"}, future)
+
+	expired := mergedSchema.ExpiredServices(future.Add(-time.Minute))
+	if len(expired) != 1 || expired[0].Name != "inventory" {
+		t.Errorf("unexpected expired services %+v", expired)
+	}
+
+	if expired := mergedSchema.ExpiredServices(time.Now().Add(-time.Minute)); len(expired) != 0 {
+		t.Errorf("services expired within their ttl: %+v", expired)
+	}
+}
+
+func TestAddServiceDetectsChangedSchemas(t *testing.T) {
+	mergedSchema := &MergedSchemas{}
+	serviceInfo := eventbus.ServiceInfo{Name: "users"}
+
+	if !mergedSchema.AddService(serviceInfo, parseSchemaResponse(t, usersItemSchemaJSON)) {
+		t.Error("new service is not reported as changed")
+	}
+	if mergedSchema.AddService(serviceInfo, parseSchemaResponse(t, usersItemSchemaJSON)) {
+		t.Error("unchanged service is reported as changed")
+	}
+	if !mergedSchema.AddService(serviceInfo, parseSchemaResponse(t, inventoryItemSchemaJSON)) {
+		t.Error("changed schema is not reported as changed")
+	}
+
+	serviceInfo.SchemaExtensions = []eventbus.SchemaExtension{{Type: "Item"}}
+	if !mergedSchema.AddService(serviceInfo, parseSchemaResponse(t, inventoryItemSchemaJSON)) {
+		t.Error("changed service info is not reported as changed")
+	}
+
+	serviceInfo.Port = "8081"
+	if mergedSchema.AddService(serviceInfo, parseSchemaResponse(t, inventoryItemSchemaJSON)) {
+		t.Error("new instance is reported as a changed schema")
+	}
+}
+
+func TestFailedBuildKeepsPublishedSchema(t *testing.T) {
+	mergedSchema := &MergedSchemas{ConflictPolicy: ConflictPolicyFail}
+	mergedSchema.AddService(eventbus.ServiceInfo{Name: "users"}, parseSchemaResponse(t, usersItemSchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mergedSchema.AddService(eventbus.ServiceInfo{Name: "inventory"}, parseSchemaResponse(t, inventoryItemSchemaJSON))
+	if _, err := mergedSchema.BuildSchema(); err == nil {
+		t.Fatal("conflicting types were merged")
+	}
+
+	published := mergedSchema.Schema()
+	if published.QueryType() != schema.QueryType() {
+		t.Error("failed build replaced the published schema")
+	}
+	if len(mergedSchema.Report().Conflicts) == 0 {
+		t.Error("report of the failed build is not published")
+	}
+}
+
+func TestQueriesDuringRebuild(t *testing.T) {
+	service := newRecordingService(`{"data":{"item":{"id":"1"}}}`)
+	defer service.server.Close()
+
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(service.serviceInfo("users"), parseSchemaResponse(t, usersItemSchemaJSON))
+	if _, err := mergedSchema.BuildSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			result := executeQuery(mergedSchema.Schema(), `{ item { id } }`)
+			if len(result.Errors) > 0 {
+				t.Errorf("query failed during rebuild: %+v", result.Errors)
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		if _, err := mergedSchema.BuildSchema(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestRequestsAreBalancedOverInstances(t *testing.T) {
+	first := newRecordingService(`{"data":{"item":{"id":"1"}}}`)
+	defer first.server.Close()
+	second := newRecordingService(`{"data":{"item":{"id":"2"}}}`)
+	defer second.server.Close()
+
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(first.serviceInfo("users"), parseSchemaResponse(t, usersItemSchemaJSON))
+	mergedSchema.AddService(second.serviceInfo("users"), parseSchemaResponse(t, usersItemSchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if result := executeQuery(schema, `{ item { id } }`); len(result.Errors) > 0 {
+			t.Fatal(result.Errors)
+		}
+	}
+
+	if len(first.queries) != 2 || len(second.queries) != 2 {
+		t.Errorf("requests were not balanced: %v and %v", len(first.queries), len(second.queries))
+	}
+
+	//an unreachable instance is left out of the rotation
+	second.server.Close()
+	executeQuery(schema, `{ item { id } }`)
+	executeQuery(schema, `{ item { id } }`)
+	for i := 0; i < 4; i++ {
+		if result := executeQuery(schema, `{ item { id } }`); len(result.Errors) > 0 {
+			t.Errorf("request went to the failed instance: %+v", result.Errors)
+		}
+	}
+
+	if mergedSchema.RemoveService(second.serviceInfo("users")) {
+		t.Error("service was removed with an instance left")
+	}
+	if !mergedSchema.RemoveService(first.serviceInfo("users")) {
+		t.Error("service was not removed with its last instance")
+	}
+}
+
+const customRootSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"RootQuery"},
+	"mutationType":{"name":"RootMutation"},
+	"types":[
+		{"kind":"OBJECT","name":"RootQuery","fields":[
+			{"name":"item","args":[],"type":{"kind":"OBJECT","name":"Item"}}
+		]},
+		{"kind":"OBJECT","name":"RootMutation","fields":[
+			{"name":"touch","args":[],"type":{"kind":"SCALAR","name":"Boolean"}}
+		]},
+		{"kind":"OBJECT","name":"Item","fields":[
+			{"name":"id","args":[],"type":{"kind":"SCALAR","name":"ID"}}
+		]}
+	]
+}}}`
+
+func TestCustomRootTypesAreRouted(t *testing.T) {
+	service := newRecordingService(`{"data":{"item":{"id":"1"},"touch":true}}`)
+	defer service.server.Close()
+
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(service.serviceInfo("custom"), parseSchemaResponse(t, customRootSchemaJSON))
+	mergedSchema.AddService(eventbus.ServiceInfo{Name: "inventory"}, parseSchemaResponse(t, inventoryItemSchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mergedSchema.current.types["RootQuery"] != nil {
+		t.Error("custom root type was merged as an object type")
+	}
+	if owner, _ := mergedSchema.FieldOwner("Query", "item"); owner != "custom" {
+		t.Errorf("Query.item owned by %v", owner)
+	}
+
+	result := executeQuery(schema, `{ item { id } }`)
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+
+	result = executeQuery(schema, `mutation { touch }`)
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+	if len(service.queries) != 2 || !strings.HasPrefix(service.queries[1], "mutation") {
+		t.Errorf("unexpected queries %v", service.queries)
+	}
+}
+
+const customRootReferenceSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"RootQuery"},
+	"types":[
+		{"kind":"OBJECT","name":"RootQuery","fields":[
+			{"name":"item","args":[],"type":{"kind":"OBJECT","name":"Item"}}
+		]},
+		{"kind":"OBJECT","name":"Item","fields":[
+			{"name":"id","args":[],"type":{"kind":"SCALAR","name":"ID"}},
+			{"name":"root","args":[],"type":{"kind":"OBJECT","name":"RootQuery"}}
+		]}
+	]
+}}}`
+
+func TestCustomRootTypesAreTranslatedPerService(t *testing.T) {
+	service := newRecordingService(`{"data":{"item":{"root":{"__typename":"RootQuery","item":{"id":"1"}}}}}`)
+	defer service.server.Close()
+
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(service.serviceInfo("custom"), parseSchemaResponse(t, customRootReferenceSchemaJSON))
+	mergedSchema.AddService(eventbus.ServiceInfo{Name: "inventory"}, parseSchemaResponse(t, inventoryItemSchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := executeQuery(schema, `{ item { root { __typename ...rootFields ... on Query { item { id } } } } } fragment rootFields on Query { __typename }`)
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+	if len(service.queries) == 0 || !strings.Contains(service.queries[0], "... on RootQuery{") ||
+		!strings.Contains(service.queries[0], "fragment rootFields on RootQuery{") {
+		t.Errorf("root type not translated for the service: %v", service.queries)
+	}
+
+	data := mergedSchema.current.getServiceResult(service.serviceInfo("custom"), map[string]interface{}{"__typename": "RootQuery"})
+	if typename := data.(map[string]interface{})["__typename"]; typename != "Query" {
+		t.Errorf("__typename of the service root type returned as %v", typename)
+	}
+
+	data = mergedSchema.current.getServiceResult(eventbus.ServiceInfo{Name: "inventory"}, map[string]interface{}{"__typename": "RootQuery"})
+	if typename := data.(map[string]interface{})["__typename"]; typename != "RootQuery" {
+		t.Errorf("__typename of another service translated to %v", typename)
+	}
+}
+
+func TestCancelledRequestsAreAborted(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//the connection is only watched for the client going away once the body is read
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer service.Close()
+
+	serviceURL, _ := url.Parse(service.URL)
+	serviceInfo := eventbus.ServiceInfo{
+		Name:                "users",
+		Hostname:            serviceURL.Hostname(),
+		Port:                serviceURL.Port(),
+		GraphQLHttpEndpoint: "/graphql",
+	}
+
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(serviceInfo, parseSchemaResponse(t, usersItemSchemaJSON))
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "Authentication", ""))
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	done := make(chan *graphql.Result, 1)
+	go func() {
+		done <- graphql.Do(graphql.Params{Schema: schema, RequestString: `{ item { id } }`, Context: ctx})
+	}()
+
+	select {
+	case result := <-done:
+		if len(result.Errors) == 0 {
+			t.Error("cancelled request returned no error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not aborted")
+	}
+
+	//the instance is still used, a cancelled request is not its failure
+	instance, _ := mergedSchema.current.pools["users"].acquire()
+	if instance == nil || !instance.failedUntil.IsZero() {
+		t.Error("instance was marked as failed")
+	}
+}
+
+// newMonitoredService accepts the sockets of monitors and hands them to the test, so the test can drop them
+func newMonitoredService() (*httptest.Server, chan *websocket.Conn) {
+	sockets := make(chan *websocket.Conn, 10)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := upgrader.Upgrade(w, r, nil); err == nil {
+			sockets <- c
+		}
+	}))
+
+	return server, sockets
+}
+
+func getMonitoredServiceInfo(address string) eventbus.ServiceInfo {
+	host, port, _ := net.SplitHostPort(address)
+	return eventbus.ServiceInfo{Name: "users", Hostname: host, Port: port, GraphQLHttpEndpoint: "/graphql", GraphQLSocketEndpoint: "/socket"}
+}
+
+func TestMonitorReportsLostSockets(t *testing.T) {
+	server, sockets := newMonitoredService()
+	defer server.Close()
+
+	down := make(chan eventbus.ServiceInfo, 10)
+	mergedSchema := &MergedSchemas{ServiceDown: func(serviceInfo eventbus.ServiceInfo) { down <- serviceInfo }}
+	serviceInfo := getMonitoredServiceInfo(server.Listener.Addr().String())
+	mergedSchema.AddService(serviceInfo, parseSchemaResponse(t, usersItemSchemaJSON))
+
+	select {
+	case c := <-sockets:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitor did not open a socket")
+	}
+
+	select {
+	case downInfo := <-down:
+		if downInfo.Hostname != serviceInfo.Hostname || downInfo.Port != serviceInfo.Port {
+			t.Errorf("wrong instance reported down: %+v", downInfo)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lost socket was not reported")
+	}
+}
+
+func TestRemovedServicesAreNotReportedDown(t *testing.T) {
+	server, sockets := newMonitoredService()
+	defer server.Close()
+
+	down := make(chan eventbus.ServiceInfo, 10)
+	mergedSchema := &MergedSchemas{ServiceDown: func(serviceInfo eventbus.ServiceInfo) { down <- serviceInfo }}
+	serviceInfo := getMonitoredServiceInfo(server.Listener.Addr().String())
+	mergedSchema.AddService(serviceInfo, parseSchemaResponse(t, usersItemSchemaJSON))
+
+	var c *websocket.Conn
+	select {
+	case c = <-sockets:
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitor did not open a socket")
+	}
+
+	mergedSchema.RemoveService(serviceInfo)
+
+	//the socket is closed by the monitor, the service sees it go away
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := c.ReadMessage(); err == nil {
+		t.Error("monitor socket was not closed")
+	}
+
+	select {
+	case downInfo := <-down:
+		t.Errorf("removed instance reported down: %+v", downInfo)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMonitorDoesNotHoldUpAddService(t *testing.T) {
+	//the listener accepts connections but never answers the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	down := make(chan eventbus.ServiceInfo, 10)
+	mergedSchema := &MergedSchemas{ServiceDown: func(serviceInfo eventbus.ServiceInfo) { down <- serviceInfo }}
+	serviceInfo := getMonitoredServiceInfo(listener.Addr().String())
+
+	added := make(chan bool)
+	go func() {
+		added <- mergedSchema.AddService(serviceInfo, parseSchemaResponse(t, usersItemSchemaJSON))
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("AddService waited for the monitor socket")
+	}
+
+	monitor := mergedSchema.monitors[getInstanceKey(serviceInfo)]
+	mergedSchema.RemoveService(serviceInfo)
+
+	select {
+	case <-monitor.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitor was not stopped while dialing")
+	}
+	if len(down) > 0 {
+		t.Errorf("removed instance reported down: %+v", <-down)
+	}
+}
@@ -0,0 +1,255 @@
+package schema
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dukfaar/goUtils/eventbus"
+)
+
+func parseServiceMap(value string) (map[string]string, error) {
+	result := make(map[string]string)
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, errors.New("Invalid service entry " + entry)
+		}
+
+		result[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return result, nil
+}
+
+// ParseServiceNamespaces reads type prefixes in the form "inventory=Inventory,users=Users"
+func ParseServiceNamespaces(value string) (map[string]string, error) {
+	return parseServiceMap(value)
+}
+
+func lowerFirst(value string) string {
+	first, size := utf8.DecodeRuneInString(value)
+	return string(unicode.ToLower(first)) + value[size:]
+}
+
+// namespace renames the types and root fields of a single service,
+// types are exposed as Prefix_Type and root fields as prefix_field
+type namespace struct {
+	prefix    string
+	typeNames map[string]string
+}
+
+func isNamespacedType(schemaType Type) bool {
+	return schemaType.Kind != "SCALAR" && !strings.HasPrefix(schemaType.Name, "__") && !isRootTypeName(schemaType.Name)
+}
+
+func newNamespace(prefix string, types []Type) *namespace {
+	n := &namespace{
+		prefix:    prefix,
+		typeNames: make(map[string]string),
+	}
+
+	for _, schemaType := range types {
+		if isNamespacedType(schemaType) {
+			n.typeNames[schemaType.Name] = prefix + "_" + schemaType.Name
+		}
+	}
+
+	return n
+}
+
+func (n *namespace) typeName(name string) string {
+	if renamed, ok := n.typeNames[name]; ok {
+		return renamed
+	}
+
+	return name
+}
+
+func (n *namespace) fieldName(name string) string {
+	return lowerFirst(n.prefix) + "_" + name
+}
+
+func (n *namespace) typeRef(fieldType FieldType) FieldType {
+	result := fieldType
+
+	if fieldType.Name != nil {
+		name := n.typeName(*fieldType.Name)
+		result.Name = &name
+	}
+
+	if fieldType.OfType != nil {
+		ofType := n.typeRef(*fieldType.OfType)
+		result.OfType = &ofType
+	}
+
+	return result
+}
+
+func (n *namespace) typeRefs(fieldTypes []FieldType) []FieldType {
+	result := make([]FieldType, 0)
+	for _, fieldType := range fieldTypes {
+		result = append(result, n.typeRef(fieldType))
+	}
+	return result
+}
+
+func (n *namespace) args(args []FieldArg) []FieldArg {
+	result := make([]FieldArg, 0)
+	for _, arg := range args {
+		arg.Type = n.typeRef(arg.Type)
+		result = append(result, arg)
+	}
+	return result
+}
+
+func (n *namespace) schemaType(schemaType Type) Type {
+	result := schemaType
+	result.Name = n.typeName(schemaType.Name)
+	result.InputFields = n.args(schemaType.InputFields)
+	result.Interfaces = n.typeRefs(schemaType.Interfaces)
+	result.PossibleTypes = n.typeRefs(schemaType.PossibleTypes)
+
+	result.Fields = make([]TypeField, 0)
+	for _, field := range schemaType.Fields {
+		if isRootTypeName(schemaType.Name) && n.prefix != "" {
+			field.Name = n.fieldName(field.Name)
+		}
+		field.Type = n.typeRef(field.Type)
+		field.Args = n.args(field.Args)
+		result.Fields = append(result.Fields, field)
+	}
+
+	return result
+}
+
+func (n *namespace) response(response Response) Response {
+	result := response
+
+	result.Data.Schema.Types = make([]Type, 0)
+	for _, schemaType := range response.Data.Schema.Types {
+		result.Data.Schema.Types = append(result.Data.Schema.Types, n.schemaType(schemaType))
+	}
+
+	result.Data.Schema.Directives = make([]Directive, 0)
+	for _, directive := range response.Data.Schema.Directives {
+		directive.Args = n.args(directive.Args)
+		result.Data.Schema.Directives = append(result.Data.Schema.Directives, directive)
+	}
+
+	return result
+}
+
+// typenames renames the __typename values of a service result, so abstract types resolve to the namespaced types
+func (n *namespace) typenames(data interface{}) interface{} {
+	switch data := data.(type) {
+	case map[string]interface{}:
+		for key, value := range data {
+			if typename, ok := value.(string); ok && key == "__typename" {
+				data[key] = n.typeName(typename)
+			} else {
+				data[key] = n.typenames(value)
+			}
+		}
+	case []interface{}:
+		for i := range data {
+			data[i] = n.typenames(data[i])
+		}
+	}
+
+	return data
+}
+
+// applyNamespace renames the schema of a service that requested a namespace and remembers the original names
+func (m *schemaBuild) applyNamespace(remoteSchema RemoteSchema) RemoteSchema {
+	prefix := m.Namespaces[remoteSchema.ServiceInfo.Name]
+	if prefix == "" {
+		return remoteSchema
+	}
+
+	types := remoteSchema.SchemaResponse.Data.Schema.Types
+	n := newNamespace(prefix, types)
+	m.namespaces[remoteSchema.ServiceInfo.Name] = n
+
+	serviceName := remoteSchema.ServiceInfo.Name
+	for _, schemaType := range types {
+		if _, renamed := n.typeNames[schemaType.Name]; renamed {
+			m.addOriginalTypeName(serviceName, n.typeName(schemaType.Name), schemaType.Name)
+		}
+
+		if !isRootTypeName(schemaType.Name) {
+			continue
+		}
+
+		if m.originalFieldNames[serviceName] == nil {
+			m.originalFieldNames[serviceName] = make(map[string]map[string]string)
+		}
+		if m.originalFieldNames[serviceName][schemaType.Name] == nil {
+			m.originalFieldNames[serviceName][schemaType.Name] = make(map[string]string)
+		}
+		for _, field := range schemaType.Fields {
+			m.originalFieldNames[serviceName][schemaType.Name][n.fieldName(field.Name)] = field.Name
+		}
+	}
+
+	return RemoteSchema{
+		ServiceInfo:    remoteSchema.ServiceInfo,
+		SchemaResponse: n.response(remoteSchema.SchemaResponse),
+	}
+}
+
+// addOriginalTypeName remembers the name a type has in its service, the names are kept per service
+// as a service without a namespace may use a name that is the namespaced name of another service's type
+func (m *schemaBuild) addOriginalTypeName(serviceName string, typeName string, originalTypeName string) {
+	if m.originalTypeNames[serviceName] == nil {
+		m.originalTypeNames[serviceName] = make(map[string]string)
+	}
+
+	m.originalTypeNames[serviceName][typeName] = originalTypeName
+}
+
+func (m *schemaBuild) getOriginalTypeName(serviceName string, typeName string) string {
+	if originalTypeName, ok := m.originalTypeNames[serviceName][typeName]; ok {
+		return originalTypeName
+	}
+
+	return typeName
+}
+
+func (m *schemaBuild) getOriginalFieldName(serviceName string, typeName string, fieldName string) string {
+	if originalFieldName, ok := m.originalFieldNames[serviceName][typeName][fieldName]; ok {
+		return originalFieldName
+	}
+
+	return fieldName
+}
+
+// getServiceTypeName returns the name a type of a service has in the merged schema
+func (m *schemaBuild) getServiceTypeName(serviceName string, typeName string) string {
+	if n := m.rootTypeNames[serviceName]; n != nil {
+		typeName = n.typeName(typeName)
+	}
+	if n := m.namespaces[serviceName]; n != nil {
+		return n.typeName(typeName)
+	}
+
+	return typeName
+}
+
+func (m *schemaBuild) getServiceResult(serviceInfo eventbus.ServiceInfo, data interface{}) interface{} {
+	if n := m.rootTypeNames[serviceInfo.Name]; n != nil {
+		data = n.typenames(data)
+	}
+	if n := m.namespaces[serviceInfo.Name]; n != nil {
+		return n.typenames(data)
+	}
+
+	return data
+}
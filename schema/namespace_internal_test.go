@@ -0,0 +1,153 @@
+package schema
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dukfaar/goUtils/eventbus"
+)
+
+const inventorySchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[
+		{"kind":"OBJECT","name":"Query","fields":[
+			{"name":"items","args":[
+				{"name":"filter","type":{"kind":"INPUT_OBJECT","name":"ItemFilter"}}
+			],"type":{"kind":"LIST","ofType":{"kind":"INTERFACE","name":"Item"}}}
+		]},
+		{"kind":"INTERFACE","name":"Item","fields":[
+			{"name":"id","args":[],"type":{"kind":"SCALAR","name":"ID"}}
+		],"possibleTypes":[{"kind":"OBJECT","name":"Tool"}]},
+		{"kind":"OBJECT","name":"Tool","fields":[
+			{"name":"id","args":[],"type":{"kind":"SCALAR","name":"ID"}}
+		],"interfaces":[{"kind":"INTERFACE","name":"Item"}]},
+		{"kind":"INPUT_OBJECT","name":"ItemFilter","inputFields":[
+			{"name":"name","type":{"kind":"SCALAR","name":"String"}}
+		]},
+		{"kind":"SCALAR","name":"ID"},
+		{"kind":"SCALAR","name":"String"}
+	]
+}}}`
+
+func TestNamespacedServiceIsTranslated(t *testing.T) {
+	service := newRecordingService(`{"data":{"items":[{"__typename":"Tool","id":"1"}]}}`)
+	defer service.server.Close()
+
+	mergedSchema := &MergedSchemas{Namespaces: map[string]string{"inventory": "Inventory"}}
+	mergedSchema.AddService(service.serviceInfo("inventory"), parseSchemaResponse(t, inventorySchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if schema.Type("Inventory_Tool") == nil || schema.Type("Tool") != nil {
+		t.Fatal("types are not namespaced")
+	}
+	if schema.QueryType().Fields()["inventory_items"] == nil {
+		t.Fatal("root fields are not namespaced")
+	}
+
+	result := executeQuery(schema, `query($filter: Inventory_ItemFilter) {
+		inventory_items(filter: $filter) { ...ItemParts }
+	}
+	fragment ItemParts on Inventory_Item { __typename ... on Inventory_Tool { id } }`)
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+
+	items := result.Data.(map[string]interface{})["inventory_items"].([]interface{})
+	if items[0].(map[string]interface{})["__typename"] != "Inventory_Tool" {
+		t.Errorf("typename not translated: %+v", items)
+	}
+
+	query := service.queries[0]
+	for _, expected := range []string{"($filter: ItemFilter)", "items(filter: $filter)", "fragment ItemParts on Item", "... on Tool{id}"} {
+		if !strings.Contains(query, expected) {
+			t.Errorf("forwarded query does not contain %v: %v", expected, query)
+		}
+	}
+	if strings.Contains(query, "Inventory") || strings.Contains(query, "inventory_") {
+		t.Errorf("forwarded query contains namespaced names: %v", query)
+	}
+}
+
+func TestExtensionsOfNamespacedServices(t *testing.T) {
+	service := newRecordingService(`{"data":{"items":[{"__typename":"Tool","id":"1"}],"tool":{"id":"2"}}}`)
+	defer service.server.Close()
+
+	serviceInfo := service.serviceInfo("inventory")
+	serviceInfo.SchemaExtensions = []eventbus.SchemaExtension{{
+		Type: "Tool",
+		Fields: []eventbus.FieldType{
+			{Name: "sibling", Type: "Tool", Resolve: eventbus.ResolveInfo{By: "tool"}},
+		},
+	}}
+
+	mergedSchema := &MergedSchemas{Namespaces: map[string]string{"inventory": "Inventory"}}
+	mergedSchema.AddService(serviceInfo, parseSchemaResponse(t, inventorySchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := executeQuery(schema, `{ inventory_items { ... on Inventory_Tool { id sibling { id } } } }`)
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+
+	items := result.Data.(map[string]interface{})["inventory_items"].([]interface{})
+	sibling, _ := items[0].(map[string]interface{})["sibling"].(map[string]interface{})
+	if sibling["id"] != "2" {
+		t.Errorf("extension field not resolved: %+v", items)
+	}
+
+	if len(service.queries) != 2 || service.queries[1] != "query {tool{id}}" {
+		t.Errorf("unexpected queries %v", service.queries)
+	}
+}
+
+const plainInventoryToolSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[
+		{"kind":"OBJECT","name":"Query","fields":[
+			{"name":"legacyTool","args":[],"type":{"kind":"OBJECT","name":"Inventory_Tool"}}
+		]},
+		{"kind":"OBJECT","name":"Inventory_Tool","fields":[
+			{"name":"id","args":[],"type":{"kind":"SCALAR","name":"ID"}}
+		]},
+		{"kind":"SCALAR","name":"ID"}
+	]
+}}}`
+
+func TestNamespacedNamesOfPlainServicesAreKept(t *testing.T) {
+	inventory := newRecordingService(`{"data":{"items":[{"__typename":"Tool","id":"1"}]}}`)
+	defer inventory.server.Close()
+	legacy := newRecordingService(`{"data":{"legacyTool":{"id":"2"}}}`)
+	defer legacy.server.Close()
+
+	mergedSchema := &MergedSchemas{Namespaces: map[string]string{"inventory": "Inventory"}}
+	mergedSchema.AddService(inventory.serviceInfo("inventory"), parseSchemaResponse(t, inventorySchemaJSON))
+	mergedSchema.AddService(legacy.serviceInfo("legacy"), parseSchemaResponse(t, plainInventoryToolSchemaJSON))
+
+	schema, err := mergedSchema.BuildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := executeQuery(schema, `{
+		inventory_items { ... on Inventory_Tool { id } }
+		legacyTool { ... on Inventory_Tool { id } }
+	}`)
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+
+	if len(inventory.queries) != 1 || !strings.Contains(inventory.queries[0], "... on Tool{id}") {
+		t.Errorf("namespaced type not translated for its service: %v", inventory.queries)
+	}
+	if len(legacy.queries) != 1 || !strings.Contains(legacy.queries[0], "... on Inventory_Tool{id}") {
+		t.Errorf("type of the plain service translated: %v", legacy.queries)
+	}
+}
@@ -1,8 +1,30 @@
 package schema
 
-import "github.com/dukfaar/goUtils/eventbus"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/dukfaar/goUtils/eventbus"
+)
 
 type RemoteSchema struct {
 	SchemaResponse Response
 	ServiceInfo    eventbus.ServiceInfo
+	Fingerprint    string
+}
+
+// getFingerprint hashes everything of a service that ends up in the merged schema,
+// the address is left out as it differs between the instances of a service
+func getFingerprint(serviceInfo eventbus.ServiceInfo, schemaResponse Response) string {
+	serviceInfo.Hostname = ""
+	serviceInfo.Port = ""
+
+	serialized, _ := json.Marshal(RemoteSchema{
+		ServiceInfo:    serviceInfo,
+		SchemaResponse: schemaResponse,
+	})
+
+	hash := sha256.Sum256(serialized)
+	return hex.EncodeToString(hash[:])
 }
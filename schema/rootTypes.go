@@ -0,0 +1,61 @@
+package schema
+
+import "errors"
+
+// getRootTypeNames maps the root types a service declared onto the root types of the gateway
+func getRootTypeNames(definition Definition) map[string]string {
+	result := make(map[string]string)
+
+	rootTypes := map[string]RootType{
+		"Query":        definition.QueryType,
+		"Mutation":     definition.MutationType,
+		"Subscription": definition.SubscriptionType,
+	}
+	for gatewayName, rootType := range rootTypes {
+		if rootType.Name != "" && rootType.Name != gatewayName {
+			result[rootType.Name] = gatewayName
+		}
+	}
+
+	return result
+}
+
+// renameRootTypes exposes the root types of a service as Query, Mutation and Subscription,
+// so a service with a root type like RootQuery gets its root fields routed like any other service.
+// The names are recorded for the service, so queries and results are translated back and forth
+func (m *schemaBuild) renameRootTypes(remoteSchema RemoteSchema) (RemoteSchema, error) {
+	definition := remoteSchema.SchemaResponse.Data.Schema
+
+	typeNames := getRootTypeNames(definition)
+	if len(typeNames) == 0 {
+		return remoteSchema, nil
+	}
+
+	gatewayNames := make(map[string]bool)
+	for _, gatewayName := range typeNames {
+		gatewayNames[gatewayName] = true
+	}
+
+	for _, schemaType := range definition.Types {
+		if _, renamed := typeNames[schemaType.Name]; gatewayNames[schemaType.Name] && !renamed {
+			return remoteSchema, errors.New("Root type cannot be renamed to " + schemaType.Name + ", a different type has that name")
+		}
+	}
+
+	n := &namespace{typeNames: typeNames}
+	m.rootTypeNames[remoteSchema.ServiceInfo.Name] = n
+	for originalName, gatewayName := range typeNames {
+		m.addOriginalTypeName(remoteSchema.ServiceInfo.Name, gatewayName, originalName)
+	}
+
+	response := n.response(remoteSchema.SchemaResponse)
+	response.Data.Schema.QueryType.Name = n.typeName(definition.QueryType.Name)
+	response.Data.Schema.MutationType.Name = n.typeName(definition.MutationType.Name)
+	response.Data.Schema.SubscriptionType.Name = n.typeName(definition.SubscriptionType.Name)
+
+	return RemoteSchema{
+		ServiceInfo:    remoteSchema.ServiceInfo,
+		SchemaResponse: response,
+		Fingerprint:    remoteSchema.Fingerprint,
+	}, nil
+}
@@ -2,6 +2,7 @@ package schema
 
 import (
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/graphql-go/graphql"
@@ -16,12 +17,29 @@ var dataScalar *graphql.Scalar = graphql.NewScalar(graphql.ScalarConfig{
 	ParseLiteral: func(valueAST ast.Value) interface{} {
 		switch valueAST := valueAST.(type) {
 		case *ast.StringValue:
-			return valueAST.Value
+			return deserializeDate(valueAST.Value)
+		case *ast.IntValue:
+			epoch, err := strconv.ParseInt(valueAST.Value, 10, 64)
+			if err != nil {
+				return nil
+			}
+			return dateFromEpoch(float64(epoch))
+		case *ast.FloatValue:
+			epoch, err := strconv.ParseFloat(valueAST.Value, 64)
+			if err != nil {
+				return nil
+			}
+			return dateFromEpoch(epoch)
 		}
 		return nil
 	},
 })
 
+// epoch values are interpreted as milliseconds, the way javascript clients send them
+func dateFromEpoch(epoch float64) time.Time {
+	return time.Unix(0, int64(epoch*float64(time.Millisecond))).UTC()
+}
+
 func serializeDate(value interface{}) interface{} {
 	switch value := value.(type) {
 	case time.Time:
@@ -43,11 +61,94 @@ func serializeDate(value interface{}) interface{} {
 }
 
 func deserializeDate(value interface{}) interface{} {
-	fmt.Println(value)
-	return nil
+	switch value := value.(type) {
+	case time.Time:
+		return value
+	case *time.Time:
+		return deserializeDate(*value)
+	case string:
+		date, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			fmt.Printf("Invalid Date %v: %v\n", value, err)
+			return nil
+		}
+		return date
+	case *string:
+		return deserializeDate(*value)
+	case float64:
+		return dateFromEpoch(value)
+	case int:
+		return dateFromEpoch(float64(value))
+	case int64:
+		return dateFromEpoch(float64(value))
+	default:
+		return nil
+	}
+}
+
+func identity(value interface{}) interface{} {
+	return value
+}
+
+func parseLiteralValue(valueAST ast.Value) interface{} {
+	switch valueAST := valueAST.(type) {
+	case *ast.StringValue:
+		return valueAST.Value
+	case *ast.BooleanValue:
+		return valueAST.Value
+	case *ast.EnumValue:
+		return valueAST.Value
+	case *ast.IntValue:
+		if intValue, err := strconv.ParseInt(valueAST.Value, 10, 64); err == nil {
+			return intValue
+		}
+		if floatValue, err := strconv.ParseFloat(valueAST.Value, 64); err == nil {
+			return floatValue
+		}
+		return valueAST.Value
+	case *ast.FloatValue:
+		if floatValue, err := strconv.ParseFloat(valueAST.Value, 64); err == nil {
+			return floatValue
+		}
+		return valueAST.Value
+	case *ast.ListValue:
+		result := make([]interface{}, 0)
+		for _, value := range valueAST.Values {
+			result = append(result, parseLiteralValue(value))
+		}
+		return result
+	case *ast.ObjectValue:
+		result := make(map[string]interface{})
+		for _, field := range valueAST.Fields {
+			result[field.Name.Value] = parseLiteralValue(field.Value)
+		}
+		return result
+	default:
+		return nil
+	}
+}
+
+// NewPassthroughScalar creates a scalar for custom scalars of services the gateway does not know,
+// values are handed through to the owning service without any interpretation
+func NewPassthroughScalar(name string) *graphql.Scalar {
+	return graphql.NewScalar(graphql.ScalarConfig{
+		Name:         name,
+		Description:  "The `" + name + "` scalar type is passed through to the service defining it.",
+		Serialize:    identity,
+		ParseValue:   identity,
+		ParseLiteral: parseLiteralValue,
+	})
+}
+
+func (m *schemaBuild) getPassthroughScalar(name string) *graphql.Scalar {
+	if m.scalars[name] == nil {
+		m.scalars[name] = NewPassthroughScalar(name)
+	}
+
+	return m.scalars[name]
 }
 
-func getScalarTypeDefinition(fieldType *FieldType) graphql.Output {
+func (m *schemaBuild) getScalarTypeDefinition(fieldType *FieldType) graphql.Output {
 	switch *fieldType.Name {
 	case "String":
 		return graphql.String
@@ -64,6 +165,6 @@ func getScalarTypeDefinition(fieldType *FieldType) graphql.Output {
 	case "Date":
 		return dataScalar
 	default:
-		panic("Unknown TypeName " + *fieldType.Name)
+		return m.getPassthroughScalar(*fieldType.Name)
 	}
 }
@@ -14,39 +14,66 @@ type FieldArg struct {
 }
 
 type TypeField struct {
-	Name string     `json:"name",omitempty`
-	Type FieldType  `json:"type,omitempty"`
-	Args []FieldArg `json:"args",omitempty`
+	Name              string     `json:"name,omitempty"`
+	Description       *string    `json:"description,omitempty"`
+	Type              FieldType  `json:"type,omitempty"`
+	Args              []FieldArg `json:"args,omitempty"`
+	IsDeprecated      bool       `json:"isDeprecated,omitempty"`
+	DeprecationReason *string    `json:"deprecationReason,omitempty"`
 }
 
 type TypeInputField struct {
-	Name string     `json:"name",omitempty`
+	Name string     `json:"name,omitempty"`
 	Type FieldType  `json:"type,omitempty"`
-	Args []FieldArg `json:"args",omitempty`
+	Args []FieldArg `json:"args,omitempty"`
+}
+
+type EnumValue struct {
+	Name              string  `json:"name,omitempty"`
+	Description       *string `json:"description,omitempty"`
+	IsDeprecated      bool    `json:"isDeprecated,omitempty"`
+	DeprecationReason *string `json:"deprecationReason,omitempty"`
 }
 
 type Type struct {
-	Name        string      `json:"name",omitempty`
-	Kind        string      `json:"kind,omitempty"`
-	Fields      []TypeField `json:"fields",omitempty`
-	InputFields []FieldArg  `json:"inputFields",omitempty`
+	Name          string      `json:"name,omitempty"`
+	Kind          string      `json:"kind,omitempty"`
+	Description   *string     `json:"description,omitempty"`
+	Fields        []TypeField `json:"fields,omitempty"`
+	InputFields   []FieldArg  `json:"inputFields,omitempty"`
+	Interfaces    []FieldType `json:"interfaces,omitempty"`
+	PossibleTypes []FieldType `json:"possibleTypes,omitempty"`
+	EnumValues    []EnumValue `json:"enumValues,omitempty"`
 }
 
 type RootType struct {
-	Name string `json:"name",omitempty`
+	Name string `json:"name,omitempty"`
+}
+
+type Directive struct {
+	Name        string     `json:"name,omitempty"`
+	Description *string    `json:"description,omitempty"`
+	Locations   []string   `json:"locations,omitempty"`
+	Args        []FieldArg `json:"args,omitempty"`
 }
 
 type Definition struct {
-	QueryType        RootType `json:"queryType",omitempty`
-	MutationType     RootType `json:"mutationType",omitempty`
-	SubscriptionType RootType `json:"subscriptionType",omitempty`
-	Types            []Type   `json:"types",omitempty`
+	QueryType        RootType    `json:"queryType,omitempty"`
+	MutationType     RootType    `json:"mutationType,omitempty"`
+	SubscriptionType RootType    `json:"subscriptionType,omitempty"`
+	Types            []Type      `json:"types,omitempty"`
+	Directives       []Directive `json:"directives,omitempty"`
 }
 
 type ResponseData struct {
 	Schema Definition `json:"__schema,omitempty"`
 }
 
+type ResponseError struct {
+	Message string `json:"message,omitempty"`
+}
+
 type Response struct {
-	Data ResponseData
+	Data   ResponseData
+	Errors []ResponseError `json:"errors,omitempty"`
 }
@@ -0,0 +1,26 @@
+package schema
+
+import "fmt"
+
+// SchemaError names the service and type that could not be merged
+type SchemaError struct {
+	Service string `json:"service"`
+	Type    string `json:"type,omitempty"`
+	Message string `json:"message"`
+}
+
+func newSchemaError(service string, typeName string, err error) *SchemaError {
+	return &SchemaError{
+		Service: service,
+		Type:    typeName,
+		Message: err.Error(),
+	}
+}
+
+func (e *SchemaError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("service %v: %v", e.Service, e.Message)
+	}
+
+	return fmt.Sprintf("service %v, type %v: %v", e.Service, e.Type, e.Message)
+}
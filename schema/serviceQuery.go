@@ -0,0 +1,82 @@
+package schema
+
+import (
+	"errors"
+	"strings"
+)
+
+// serviceQuery builds the query of one service. Fields the service does not define, or defines with a different type
+// than the merged field, are collected as errors instead of being sent to a service that would reject or mistype them
+type serviceQuery struct {
+	*schemaBuild
+	service string
+	errors  []string
+}
+
+func (m *schemaBuild) newServiceQuery(service string) *serviceQuery {
+	return &serviceQuery{
+		schemaBuild: m,
+		service:     service,
+	}
+}
+
+// recordServiceFields remembers the fields every service defines, shared types can hold fields of several services
+func (m *schemaBuild) recordServiceFields(serviceName string, schemaType Type) {
+	if m.serviceFields[serviceName] == nil {
+		m.serviceFields[serviceName] = make(map[string]map[string]string)
+	}
+
+	fields := make(map[string]string)
+	for _, field := range schemaType.Fields {
+		fields[field.Name] = getFieldSignature(field)
+	}
+	m.serviceFields[serviceName][schemaType.Name] = fields
+}
+
+func (m *serviceQuery) addError(message string) {
+	for _, known := range m.errors {
+		if known == message {
+			return
+		}
+	}
+
+	m.errors = append(m.errors, message)
+}
+
+// getOriginalTypeName returns the name a type of the merged schema has in the service
+func (m *serviceQuery) getOriginalTypeName(typeName string) string {
+	return m.schemaBuild.getOriginalTypeName(m.service, typeName)
+}
+
+func (m *serviceQuery) getOriginalFieldName(typeName string, fieldName string) string {
+	return m.schemaBuild.getOriginalFieldName(m.service, typeName, fieldName)
+}
+
+// checkField returns whether the service can answer a field of the merged schema
+func (m *serviceQuery) checkField(typeName string, fieldName string) bool {
+	owner, owned := m.fieldOwners[typeName][fieldName]
+	if !owned || owner.service == m.service {
+		return true
+	}
+
+	signature, defined := m.serviceFields[m.service][typeName][fieldName]
+	if !defined {
+		m.addError("Field " + typeName + "." + fieldName + " is not provided by service " + m.service)
+		return false
+	}
+
+	if signature != owner.signature {
+		m.addError("Field " + typeName + "." + fieldName + " of service " + m.service + " conflicts with the one of service " + owner.service)
+		return false
+	}
+
+	return true
+}
+
+func (m *serviceQuery) err() error {
+	if len(m.errors) == 0 {
+		return nil
+	}
+
+	return errors.New(strings.Join(m.errors, "; "))
+}
@@ -0,0 +1,341 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/dukfaar/goUtils/eventbus"
+	dukGraphql "github.com/dukfaar/goUtils/graphql"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// subscriptionId is the id of the forwarded subscription, every subscription has a socket of its own
+const subscriptionId = "1"
+
+type subscriptionMessage struct {
+	Id      string      `json:"id,omitempty"`
+	Type    string      `json:"type"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+type subscriptionEvent struct {
+	Id      string          `json:"id"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type subscriptionPayload struct {
+	Data   map[string]interface{}     `json:"data"`
+	Errors []gqlerrors.FormattedError `json:"errors"`
+}
+
+func errorResult(err error) *graphql.Result {
+	return &graphql.Result{Errors: []gqlerrors.FormattedError{gqlerrors.FormatError(err)}}
+}
+
+func getOperation(document *ast.Document, operationName string) *ast.OperationDefinition {
+	var result *ast.OperationDefinition
+	for _, definition := range document.Definitions {
+		operation, ok := definition.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+
+		if operationName == "" && result != nil {
+			return nil
+		}
+
+		if operationName == "" || (operation.Name != nil && operation.Name.Value == operationName) {
+			result = operation
+		}
+	}
+
+	return result
+}
+
+// IsSubscription returns whether the operation of a request is a subscription, requests that cannot be parsed are not
+func IsSubscription(request dukGraphql.Request) bool {
+	document, err := parser.Parse(parser.ParseParams{Source: request.Query})
+	if err != nil {
+		return false
+	}
+
+	operation := getOperation(document, request.OperationName)
+	return operation != nil && operation.Operation == "subscription"
+}
+
+// subscription is a subscription of a client that was validated against the merged schema
+type subscription struct {
+	request   dukGraphql.Request
+	document  *ast.Document
+	field     *ast.Field
+	query     string
+	fieldName string
+	service   string
+}
+
+func (m *schemaBuild) parseSubscription(request dukGraphql.Request) (*subscription, []gqlerrors.FormattedError) {
+	document, err := parser.Parse(parser.ParseParams{Source: request.Query})
+	if err != nil {
+		return nil, gqlerrors.FormatErrors(err)
+	}
+
+	validation := graphql.ValidateDocument(&m.schema, document, nil)
+	if !validation.IsValid {
+		return nil, validation.Errors
+	}
+
+	operation := getOperation(document, request.OperationName)
+	if operation == nil || operation.Operation != "subscription" {
+		return nil, gqlerrors.FormatErrors(errors.New("Request contains no subscription " + request.OperationName))
+	}
+
+	//the events of one service cannot be merged with the events of another, so a subscription selects exactly one root field
+	if len(operation.SelectionSet.Selections) != 1 {
+		return nil, gqlerrors.FormatErrors(errors.New("Subscriptions must select exactly one field"))
+	}
+	field, ok := operation.SelectionSet.Selections[0].(*ast.Field)
+	if !ok {
+		return nil, gqlerrors.FormatErrors(errors.New("Subscriptions must select exactly one field"))
+	}
+
+	owner, owned := m.fieldOwners["Subscription"][field.Name.Value]
+	if !owned {
+		return nil, gqlerrors.FormatErrors(errors.New("Unknown subscription field " + field.Name.Value))
+	}
+
+	fragments := make(map[string]ast.Definition)
+	for _, definition := range document.Definitions {
+		if fragment, ok := definition.(*ast.FragmentDefinition); ok {
+			fragments[fragment.Name.Value] = fragment
+		}
+	}
+
+	//the query is rebuilt like the query of a resolver, so names and fragments are translated for the service
+	p := graphql.ResolveParams{
+		Info: graphql.ResolveInfo{
+			FieldName:      field.Name.Value,
+			FieldASTs:      []*ast.Field{field},
+			ParentType:     m.types["Subscription"],
+			Fragments:      fragments,
+			Operation:      operation,
+			VariableValues: request.Variables,
+		},
+	}
+
+	checker := NewFragmentChecker(fragments)
+	checker.MarkFields(p)
+
+	serviceQuery := m.newServiceQuery(owner.service)
+	query := "subscription" + serviceQuery.getQueryArgs(p, checker) + " {" + serviceQuery.getSourceBody(p) + "}" + serviceQuery.getFragments(p, checker)
+	if err := serviceQuery.err(); err != nil {
+		return nil, gqlerrors.FormatErrors(err)
+	}
+
+	return &subscription{
+		request:   request,
+		document:  document,
+		field:     field,
+		query:     query,
+		fieldName: field.Name.Value,
+		service:   owner.service,
+	}, nil
+}
+
+func dialSubscription(ctx context.Context, serviceInfo eventbus.ServiceInfo, s *subscription) (*websocket.Conn, error) {
+	authValue, _ := ctx.Value("Authentication").(string)
+
+	header := make(http.Header)
+	if authValue != "" {
+		header.Add("Authentication", authValue)
+		header.Add("Authorization", authValue)
+	}
+
+	//the dialer only applies the deadline of the context to the handshake, so the connection is closed once the client is gone
+	handshakeDone := make(chan struct{})
+	dialer := &websocket.Dialer{
+		Subprotocols: []string{"graphql-ws"},
+		NetDialContext: func(dialCtx context.Context, network string, address string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(dialCtx, network, address)
+			if err != nil {
+				return nil, err
+			}
+
+			go func() {
+				select {
+				case <-ctx.Done():
+					conn.Close()
+				case <-handshakeDone:
+				}
+			}()
+			return conn, nil
+		},
+	}
+	c, _, err := dialer.DialContext(ctx, "ws://"+serviceInfo.Hostname+":"+serviceInfo.Port+serviceInfo.GraphQLSocketEndpoint, header)
+	close(handshakeDone)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.WriteJSON(subscriptionMessage{
+		Type:    "connection_init",
+		Payload: map[string]interface{}{"Authentication": authValue},
+	})
+	if err == nil {
+		err = c.WriteJSON(subscriptionMessage{
+			Id:   subscriptionId,
+			Type: "start",
+			Payload: dukGraphql.Request{
+				Query:     s.query,
+				Variables: s.request.Variables,
+			},
+		})
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// getEventResult runs an event of the service through the merged schema, so the event is shaped like the client asked for
+// and fields of extending services are resolved
+func (m *schemaBuild) getEventResult(ctx context.Context, serviceInfo eventbus.ServiceInfo, s *subscription, payload subscriptionPayload) *graphql.Result {
+	root := map[string]interface{}{
+		s.fieldName: m.getServiceResult(serviceInfo, payload.Data[m.getOriginalFieldName(s.service, "Subscription", s.fieldName)]),
+	}
+
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        m.schema,
+		Root:          root,
+		AST:           s.document,
+		OperationName: s.request.OperationName,
+		Args:          s.request.Variables,
+		Context:       ctx,
+	})
+	result.Errors = append(payload.Errors, result.Errors...)
+
+	return result
+}
+
+// forwardEvents reads the events of the service until it completes the subscription or the socket is closed
+func (m *schemaBuild) forwardEvents(ctx context.Context, c *websocket.Conn, serviceInfo eventbus.ServiceInfo, s *subscription, results chan<- *graphql.Result) error {
+	for {
+		var event subscriptionEvent
+		if err := c.ReadJSON(&event); err != nil {
+			return err
+		}
+
+		var result *graphql.Result
+		switch event.Type {
+		case "data":
+			var payload subscriptionPayload
+			if err := json.Unmarshal(event.Payload, &payload); err != nil {
+				return fmt.Errorf("Invalid event from service %v: %v", serviceInfo.Name, err)
+			}
+			result = m.getEventResult(ctx, serviceInfo, s, payload)
+		case "error", "connection_error":
+			return fmt.Errorf("Subscription failed in service %v: %s", serviceInfo.Name, event.Payload)
+		case "complete":
+			return nil
+		default:
+			continue
+		}
+
+		select {
+		case results <- result:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (m *schemaBuild) subscribe(ctx context.Context, request dukGraphql.Request, results chan<- *graphql.Result) {
+	defer close(results)
+
+	sendResult := func(result *graphql.Result) {
+		select {
+		case results <- result:
+		case <-ctx.Done():
+		}
+	}
+
+	s, errs := m.parseSubscription(request)
+	if len(errs) > 0 {
+		sendResult(&graphql.Result{Errors: errs})
+		return
+	}
+
+	pool := m.pools[s.service]
+	if pool == nil {
+		sendResult(errorResult(errors.New("No instance of service " + s.service + " available")))
+		return
+	}
+
+	instance, instanceInfo := pool.acquire()
+	if instance == nil {
+		sendResult(errorResult(errors.New("No instance of service " + s.service + " available")))
+		return
+	}
+
+	c, err := dialSubscription(ctx, instanceInfo, s)
+	if err != nil {
+		//a handshake cancelled by the client is not a failure of the instance
+		pool.release(instance, ctx.Err() == nil)
+		sendResult(errorResult(fmt.Errorf("Subscription to service %v failed: %v", s.service, err)))
+		return
+	}
+	defer pool.release(instance, false)
+
+	//the socket is only written to again once the client is gone, reading is stopped by closing it
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.WriteJSON(subscriptionMessage{Id: subscriptionId, Type: "stop"})
+			c.WriteJSON(subscriptionMessage{Type: "connection_terminate"})
+		case <-done:
+		}
+		c.Close()
+	}()
+
+	if err := m.forwardEvents(ctx, c, instanceInfo, s, results); err != nil && ctx.Err() == nil {
+		sendResult(errorResult(err))
+	}
+}
+
+// Subscribe forwards a subscription to the service that owns its root field and returns a result for every event of the service.
+// The channel is closed once the service completes the subscription or the context is done
+func (m *MergedSchemas) Subscribe(ctx context.Context, request dukGraphql.Request) <-chan *graphql.Result {
+	results := make(chan *graphql.Result)
+
+	m.mutex.RLock()
+	build := m.current
+	m.mutex.RUnlock()
+
+	if build == nil {
+		go func() {
+			defer close(results)
+			select {
+			case results <- errorResult(errors.New("No schema available")):
+			case <-ctx.Done():
+			}
+		}()
+		return results
+	}
+
+	go build.subscribe(ctx, request, results)
+
+	return results
+}
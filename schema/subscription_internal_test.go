@@ -0,0 +1,230 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dukfaar/goUtils/eventbus"
+	dukGraphql "github.com/dukfaar/goUtils/graphql"
+	"github.com/gorilla/websocket"
+)
+
+const subscriptionSchemaJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"subscriptionType":{"name":"Subscription"},
+	"types":[
+		{"kind":"OBJECT","name":"Query","fields":[
+			{"name":"user","args":[],"type":{"kind":"OBJECT","name":"User"}}
+		]},
+		{"kind":"OBJECT","name":"Subscription","fields":[
+			{"name":"userAdded","args":[
+				{"name":"group","type":{"kind":"SCALAR","name":"String"}}
+			],"type":{"kind":"OBJECT","name":"User"}}
+		]},
+		{"kind":"OBJECT","name":"User","fields":[
+			{"name":"id","args":[],"type":{"kind":"SCALAR","name":"ID"}},
+			{"name":"name","args":[],"type":{"kind":"SCALAR","name":"String"}}
+		]},
+		{"kind":"SCALAR","name":"ID"},
+		{"kind":"SCALAR","name":"String"}
+	]
+}}}`
+
+// subscriptionService answers every subscription with the given events and completes it, unless hold is set
+type subscriptionService struct {
+	server  *httptest.Server
+	queries chan string
+	stopped chan bool
+}
+
+func newSubscriptionService(events []string, hold bool) *subscriptionService {
+	service := &subscriptionService{
+		queries: make(chan string, 10),
+		stopped: make(chan bool, 10),
+	}
+
+	upgrader := websocket.Upgrader{}
+	service.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		for {
+			var message subscriptionEvent
+			if err := c.ReadJSON(&message); err != nil {
+				return
+			}
+
+			switch message.Type {
+			case "start":
+				var request dukGraphql.Request
+				json.Unmarshal(message.Payload, &request)
+				service.queries <- request.Query
+
+				for _, event := range events {
+					c.WriteJSON(subscriptionEvent{Id: message.Id, Type: "data", Payload: json.RawMessage(event)})
+				}
+				if !hold {
+					c.WriteJSON(subscriptionEvent{Id: message.Id, Type: "complete"})
+				}
+			case "stop":
+				service.stopped <- true
+			}
+		}
+	}))
+	return service
+}
+
+func (s *subscriptionService) serviceInfo(name string) eventbus.ServiceInfo {
+	serviceURL, _ := url.Parse(s.server.URL)
+	return eventbus.ServiceInfo{
+		Name:                  name,
+		Hostname:              serviceURL.Hostname(),
+		Port:                  serviceURL.Port(),
+		GraphQLHttpEndpoint:   "/graphql",
+		GraphQLSocketEndpoint: "/socket",
+	}
+}
+
+func TestSubscriptionEventsAreForwarded(t *testing.T) {
+	service := newSubscriptionService([]string{
+		`{"data":{"userAdded":{"id":"1","name":"first"}}}`,
+		`{"data":{"userAdded":{"id":"2","name":"second"}}}`,
+	}, false)
+	defer service.server.Close()
+
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(service.serviceInfo("users"), parseSchemaResponse(t, subscriptionSchemaJSON))
+	if _, err := mergedSchema.BuildSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := dukGraphql.Request{Query: `subscription($group: String) { added: userAdded(group: $group) { ...userFields } } fragment userFields on User { name }`}
+	if !IsSubscription(request) {
+		t.Fatal("subscription not detected")
+	}
+	request.Variables = map[string]interface{}{"group": "admins"}
+
+	names := make([]interface{}, 0)
+	for result := range mergedSchema.Subscribe(context.Background(), request) {
+		if len(result.Errors) > 0 {
+			t.Fatal(result.Errors)
+		}
+		added, _ := result.Data.(map[string]interface{})["added"].(map[string]interface{})
+		names = append(names, added["name"])
+	}
+
+	if len(names) != 2 || names[0] != "first" || names[1] != "second" {
+		t.Errorf("unexpected events %v", names)
+	}
+
+	query := <-service.queries
+	expected := "subscription($group: String) {userAdded(group: $group){...userFields}} fragment userFields on User{name}"
+	if query != expected {
+		t.Errorf("unexpected forwarded subscription %v", query)
+	}
+}
+
+func TestSubscriptionIsStoppedWithItsContext(t *testing.T) {
+	service := newSubscriptionService([]string{`{"data":{"userAdded":{"id":"1"}}}`}, true)
+	defer service.server.Close()
+
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(service.serviceInfo("users"), parseSchemaResponse(t, subscriptionSchemaJSON))
+	if _, err := mergedSchema.BuildSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results := mergedSchema.Subscribe(ctx, dukGraphql.Request{Query: `subscription { userAdded { id } }`})
+
+	if result := <-results; len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+	cancel()
+
+	select {
+	case <-service.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription was not stopped in the service")
+	}
+
+	for range results {
+	}
+}
+
+func TestSubscriptionHandshakeIsCancelledWithItsContext(t *testing.T) {
+	//the listener accepts connections but never answers the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(eventbus.ServiceInfo{Name: "users", Hostname: host, Port: port, GraphQLSocketEndpoint: "/socket"}, parseSchemaResponse(t, subscriptionSchemaJSON))
+	if _, err := mergedSchema.BuildSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results := mergedSchema.Subscribe(ctx, dukGraphql.Request{Query: `subscription { userAdded { id } }`})
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	done := make(chan struct{})
+	go func() {
+		for range results {
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake was not cancelled")
+	}
+
+	//the instance is still used, a cancelled handshake is not its failure
+	instance, _ := mergedSchema.current.pools["users"].acquire()
+	if instance == nil || !instance.failedUntil.IsZero() {
+		t.Error("instance was marked as failed")
+	}
+}
+
+func TestInvalidSubscriptionsAreRejected(t *testing.T) {
+	mergedSchema := &MergedSchemas{}
+	mergedSchema.AddService(eventbus.ServiceInfo{Name: "users"}, parseSchemaResponse(t, subscriptionSchemaJSON))
+	if _, err := mergedSchema.BuildSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := []string{
+		`subscription { unknown }`,
+		`subscription { userAdded { id } other: userAdded { id } }`,
+		`{ user { id } }`,
+	}
+	for _, query := range queries {
+		result := <-mergedSchema.Subscribe(context.Background(), dukGraphql.Request{Query: query})
+		if result == nil || len(result.Errors) == 0 {
+			t.Errorf("%v was not rejected", query)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package schema
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var namePattern = regexp.MustCompile("^[_a-zA-Z][_a-zA-Z0-9]*$")
+
+func validateName(kind string, name string) error {
+	if !namePattern.MatchString(name) {
+		return errors.New("Invalid " + kind + " name \"" + name + "\"")
+	}
+
+	return nil
+}
+
+func validateTypeRefs(kind string, typeRefs []FieldType, kinds map[string]string, expectedKind string) error {
+	for _, typeRef := range typeRefs {
+		if typeRef.Name == nil {
+			return errors.New(kind + " without a name")
+		}
+
+		if kinds[*typeRef.Name] != expectedKind {
+			return errors.New(kind + " " + *typeRef.Name + " is not defined")
+		}
+	}
+
+	return nil
+}
+
+func validateType(schemaType Type, kinds map[string]string) error {
+	if err := validateName("type", schemaType.Name); err != nil {
+		return err
+	}
+
+	for _, field := range schemaType.Fields {
+		if err := validateName("field", field.Name); err != nil {
+			return err
+		}
+
+		for _, arg := range field.Args {
+			if err := validateName("argument", arg.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, inputField := range schemaType.InputFields {
+		if err := validateName("input field", inputField.Name); err != nil {
+			return err
+		}
+	}
+
+	for _, enumValue := range schemaType.EnumValues {
+		if err := validateName("enum value", enumValue.Name); err != nil {
+			return err
+		}
+	}
+
+	if err := validateTypeRefs("Interface", schemaType.Interfaces, kinds, "INTERFACE"); err != nil {
+		return err
+	}
+
+	if schemaType.Kind == "UNION" {
+		if len(schemaType.PossibleTypes) == 0 {
+			return errors.New("Union without members")
+		}
+
+		return validateTypeRefs("Union member", schemaType.PossibleTypes, kinds, "OBJECT")
+	}
+
+	return nil
+}
+
+// validateTypes checks the types of a service for what graphql-go would only refuse for the merged schema as a whole,
+// so the service can be left out instead. It returns the name of the invalid type
+func validateTypes(types []Type) (string, error) {
+	kinds := make(map[string]string)
+	for _, schemaType := range types {
+		kinds[schemaType.Name] = schemaType.Kind
+	}
+
+	for _, schemaType := range types {
+		if strings.HasPrefix(schemaType.Name, "__") {
+			continue
+		}
+
+		if err := validateType(schemaType, kinds); err != nil {
+			return schemaType.Name, err
+		}
+	}
+
+	return "", nil
+}
+
+func validateRootType(definition Definition, rootType RootType) error {
+	if rootType.Name == "" {
+		return nil
+	}
+
+	for _, schemaType := range definition.Types {
+		if schemaType.Name == rootType.Name {
+			if schemaType.Kind != "OBJECT" {
+				return errors.New("Root type " + rootType.Name + " is not an object")
+			}
+			return nil
+		}
+	}
+
+	return errors.New("Root type " + rootType.Name + " is not defined")
+}
+
+// ValidateResponse checks that an introspection response describes a schema that can be merged
+func ValidateResponse(response Response) error {
+	if len(response.Errors) > 0 {
+		messages := make([]string, 0)
+		for _, responseError := range response.Errors {
+			messages = append(messages, responseError.Message)
+		}
+
+		return errors.New("Introspection failed: " + strings.Join(messages, "; "))
+	}
+
+	definition := response.Data.Schema
+	if len(definition.Types) == 0 {
+		return errors.New("Response contains no __schema")
+	}
+
+	if definition.QueryType.Name == "" {
+		return errors.New("Schema has no query type")
+	}
+
+	if err := validateRootType(definition, definition.QueryType); err != nil {
+		return err
+	}
+	if err := validateRootType(definition, definition.MutationType); err != nil {
+		return err
+	}
+
+	return validateRootType(definition, definition.SubscriptionType)
+}
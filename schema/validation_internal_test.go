@@ -0,0 +1,29 @@
+package schema
+
+import "testing"
+
+func TestValidateResponse(t *testing.T) {
+	if err := ValidateResponse(parseSchemaResponse(t, usersItemSchemaJSON)); err != nil {
+		t.Errorf("valid response rejected: %v", err)
+	}
+
+	invalidResponses := map[string]string{
+		"empty":  `{}`,
+		"errors": `{"errors":[{"message":"introspection disabled"}]}`,
+		"no query type": `{"data":{"__schema":{"types":[
+			{"kind":"OBJECT","name":"Query","fields":[]}
+		]}}}`,
+		"query type not an object": `{"data":{"__schema":{"queryType":{"name":"RootQuery"},"types":[
+			{"kind":"INPUT_OBJECT","name":"RootQuery","inputFields":[]}
+		]}}}`,
+		"undefined mutation type": `{"data":{"__schema":{"queryType":{"name":"Query"},"mutationType":{"name":"Mutation"},"types":[
+			{"kind":"OBJECT","name":"Query","fields":[]}
+		]}}}`,
+	}
+
+	for name, responseJSON := range invalidResponses {
+		if err := ValidateResponse(parseSchemaResponse(t, responseJSON)); err == nil {
+			t.Errorf("%v response accepted", name)
+		}
+	}
+}
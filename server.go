@@ -10,6 +10,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/dukfaar/goUtils/env"
@@ -20,67 +22,253 @@ import (
 	"github.com/dukfaar/apiGateway/schema"
 	dukGraphql "github.com/dukfaar/goUtils/graphql"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+var evictedServices = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "apigateway_evicted_services_total",
+	Help: "Service instances evicted because they stopped answering heartbeats",
+}, []string{"service"})
+
+var invalidIntrospections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "apigateway_invalid_introspections_total",
+	Help: "Introspection responses of services that were refused instead of merged",
+}, []string{"service"})
+
+func init() {
+	prometheus.MustRegister(evictedServices, invalidIntrospections)
+}
+
 type SchemaProvider interface {
 	GetSchema() graphql.Schema
+	Subscribe(ctx context.Context, request dukGraphql.Request) <-chan *graphql.Result
 }
 
 type ServiceProcessor struct {
 	MergedSchemas schema.MergedSchemas
-	CurrentSchema graphql.Schema
 
-	ServiceChannel chan eventbus.ServiceInfo
+	ServiceChannel     chan eventbus.ServiceInfo
+	ServiceDownChannel chan eventbus.ServiceInfo
+	HeartbeatChannel   chan time.Duration
+	SchemaChannel      chan introspectionResult
+
+	HeartbeatResultChannel chan heartbeatResult
+
+	IntrospectionRetries int
+	IntrospectionTimeout time.Duration
+	IntrospectionBackoff time.Duration
+
+	pendingMutex sync.Mutex
+	pending      map[string]*PendingService
+
+	//heartbeatRunning is only used by the channel watcher
+	heartbeatRunning bool
 }
 
 func (p *ServiceProcessor) GetSchema() graphql.Schema {
-	return p.CurrentSchema
+	return p.MergedSchemas.Schema()
 }
 
-func (p *ServiceProcessor) processResponse(serviceInfo eventbus.ServiceInfo, response schema.Response) {
-	p.MergedSchemas.AddService(serviceInfo, response)
+func (p *ServiceProcessor) Subscribe(ctx context.Context, request dukGraphql.Request) <-chan *graphql.Result {
+	return p.MergedSchemas.Subscribe(ctx, request)
+}
 
-	newCurrentSchema, err := p.MergedSchemas.BuildSchema()
+func (p *ServiceProcessor) buildSchema() {
+	_, err := p.MergedSchemas.BuildSchema()
 
+	for _, conflict := range p.MergedSchemas.Report().Conflicts {
+		fmt.Printf("Type conflict: %v\n", conflict)
+	}
+
+	for _, failedService := range p.MergedSchemas.Report().FailedServices {
+		fmt.Printf("Service left out of the schema: %v\n", failedService.Error())
+	}
+
+	//a failed build keeps serving the last schema that was built successfully
 	if err != nil {
 		fmt.Println(err)
+	}
+}
+
+func (p *ServiceProcessor) processResponse(serviceInfo eventbus.ServiceInfo, response schema.Response) {
+	if !p.MergedSchemas.AddService(serviceInfo, response) {
 		return
 	}
 
-	p.CurrentSchema = newCurrentSchema
+	p.buildSchema()
 }
 
+func (p *ServiceProcessor) serviceDown(serviceInfo eventbus.ServiceInfo) {
+	if !p.MergedSchemas.RemoveService(serviceInfo) {
+		return
+	}
+
+	fmt.Printf("Removing service %v\n", serviceInfo.Name)
+	p.buildSchema()
+}
+
+// serviceUp introspects an announced service in the background, the service is pending until its schema arrives
 func (p *ServiceProcessor) serviceUp(serviceInfo eventbus.ServiceInfo) {
+	if !p.markPending(serviceInfo) {
+		return
+	}
+
+	go func() {
+		response, err := p.introspectWithRetry(serviceInfo)
+		if _, invalid := err.(*invalidIntrospectionError); invalid {
+			fmt.Printf("Refusing schema of service %v: %v\n", serviceInfo.Name, err)
+			p.clearPending(serviceInfo)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Giving up introspecting service %v: %v\n", serviceInfo.Name, err)
+			p.clearPending(serviceInfo)
+			return
+		}
+
+		p.SchemaChannel <- introspectionResult{serviceInfo: serviceInfo, response: response}
+	}()
+}
+
+func probeService(serviceInfo eventbus.ServiceInfo) error {
 	jsonValue, _ := json.Marshal(dukGraphql.Request{
-		Query: IntrospectionQuery,
+		Query: "{__typename}",
 	})
-	resp, err := http.Post("http://"+serviceInfo.Hostname+":"+serviceInfo.Port+serviceInfo.GraphQLHttpEndpoint, "application/json", bytes.NewBuffer(jsonValue))
 
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post("http://"+serviceInfo.Hostname+":"+serviceInfo.Port+serviceInfo.GraphQLHttpEndpoint, "application/json", bytes.NewBuffer(jsonValue))
 	if err != nil {
-		fmt.Println(err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %v", resp.Status)
+	}
+
+	return nil
+}
+
+// heartbeatResult holds the instances that answered a heartbeat
+type heartbeatResult struct {
+	seenServices []eventbus.ServiceInfo
+	seen         time.Time
+	ttl          time.Duration
+}
+
+// probeServices probes the instances concurrently and returns the ones that answered
+func probeServices(services []eventbus.ServiceInfo) []eventbus.ServiceInfo {
+	seenServices := make(chan eventbus.ServiceInfo, len(services))
+
+	var wg sync.WaitGroup
+	for _, serviceInfo := range services {
+		wg.Add(1)
+		go func(serviceInfo eventbus.ServiceInfo) {
+			defer wg.Done()
+
+			if err := probeService(serviceInfo); err != nil {
+				fmt.Printf("Heartbeat of service %v failed: %v\n", serviceInfo.Name, err)
+				return
+			}
+
+			seenServices <- serviceInfo
+		}(serviceInfo)
+	}
+	wg.Wait()
+	close(seenServices)
+
+	result := make([]eventbus.ServiceInfo, 0)
+	for serviceInfo := range seenServices {
+		result = append(result, serviceInfo)
+	}
+
+	return result
+}
+
+// checkServices probes all services in the background, so the channel watcher keeps handling other events meanwhile.
+// A heartbeat is skipped while the probes of the last one are still running
+func (p *ServiceProcessor) checkServices(ttl time.Duration) {
+	if p.heartbeatRunning {
 		return
 	}
+	p.heartbeatRunning = true
 
-	defer resp.Body.Close()
+	services := p.MergedSchemas.Services()
+	go func() {
+		seenServices := probeServices(services)
+		p.HeartbeatResultChannel <- heartbeatResult{seenServices: seenServices, seen: time.Now(), ttl: ttl}
+	}()
+}
+
+// evictServices marks the instances that answered a heartbeat as seen and evicts the ones that have not been seen within the ttl
+func (p *ServiceProcessor) evictServices(result heartbeatResult) {
+	p.heartbeatRunning = false
+
+	for _, serviceInfo := range result.seenServices {
+		p.MergedSchemas.MarkServiceSeen(serviceInfo, result.seen)
+	}
+
+	removedServices := false
+	for _, serviceInfo := range p.MergedSchemas.ExpiredServices(result.seen.Add(-result.ttl)) {
+		fmt.Printf("Evicting instance %v:%v of service %v\n", serviceInfo.Hostname, serviceInfo.Port, serviceInfo.Name)
+		evictedServices.WithLabelValues(serviceInfo.Name).Inc()
+
+		if p.MergedSchemas.RemoveService(serviceInfo) {
+			removedServices = true
+		}
+	}
 
-	var schemaResponse schema.Response
-	json.NewDecoder(resp.Body).Decode(&schemaResponse)
+	if removedServices {
+		p.buildSchema()
+	}
+}
 
-	p.processResponse(serviceInfo, schemaResponse)
+// StartHeartbeat checks the services in every interval, services not seen within the ttl are evicted
+func (p *ServiceProcessor) StartHeartbeat(interval time.Duration, ttl time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			<-ticker.C
+			p.HeartbeatChannel <- ttl
+		}
+	}()
 }
 
 func (p *ServiceProcessor) StartChannelWatcher() {
 	go func() {
 		for {
-			p.serviceUp(<-p.ServiceChannel)
+			select {
+			case serviceInfo := <-p.ServiceChannel:
+				p.serviceUp(serviceInfo)
+			case result := <-p.SchemaChannel:
+				p.clearPending(result.serviceInfo)
+				p.processResponse(result.serviceInfo, result.response)
+			case serviceInfo := <-p.ServiceDownChannel:
+				p.serviceDown(serviceInfo)
+			case ttl := <-p.HeartbeatChannel:
+				p.checkServices(ttl)
+			case result := <-p.HeartbeatResultChannel:
+				p.evictServices(result)
+			}
 		}
 	}()
 }
 
 func NewServiceProcessor() *ServiceProcessor {
 	var newProcessor = &ServiceProcessor{
-		ServiceChannel: make(chan eventbus.ServiceInfo),
+		ServiceChannel:     make(chan eventbus.ServiceInfo),
+		ServiceDownChannel: make(chan eventbus.ServiceInfo),
+		HeartbeatChannel:   make(chan time.Duration),
+		SchemaChannel:      make(chan introspectionResult),
+
+		HeartbeatResultChannel: make(chan heartbeatResult),
+
+		IntrospectionRetries: 5,
+		IntrospectionTimeout: 10 * time.Second,
+		IntrospectionBackoff: 500 * time.Millisecond,
+
+		pending: make(map[string]*PendingService),
 	}
 
 	newProcessor.StartChannelWatcher()
@@ -119,7 +307,7 @@ func GetAuthValue(r *http.Request) string {
 	return ""
 }
 
-func main() {
+func startNsqDiscovery(newServiceProcessor *ServiceProcessor) {
 	nsqEventbus := eventbus.NewNsqEventBus(env.GetDefaultEnvVar("NSQD_TCP_URL", "localhost:4150"), env.GetDefaultEnvVar("NSQLOOKUP_HTTP_URL", "localhost:4161"))
 
 	serviceInfo := eventbus.ServiceInfo{
@@ -131,8 +319,6 @@ func main() {
 
 	hostname, _ := os.Hostname()
 
-	newServiceProcessor := NewServiceProcessor()
-
 	nsqEventbus.On("service.up", "apigateway_"+hostname, func(msg []byte) error {
 		newService := eventbus.ServiceInfo{}
 		err := json.Unmarshal(msg, &newService)
@@ -148,6 +334,21 @@ func main() {
 		return nil
 	})
 
+	nsqEventbus.On("service.down", "apigateway_"+hostname, func(msg []byte) error {
+		downService := eventbus.ServiceInfo{}
+		err := json.Unmarshal(msg, &downService)
+		if err != nil {
+			fmt.Printf("Error unmarshalling serviceInfo: %+v\n", string(msg))
+			return nil
+		}
+
+		if downService.Name != "apigateway" {
+			newServiceProcessor.ServiceDownChannel <- downService
+		}
+
+		return nil
+	})
+
 	nsqEventbus.Emit("service.up", serviceInfo)
 
 	//send a refreshing call every 5 minutes until i have solution in my infrastructure
@@ -158,6 +359,104 @@ func main() {
 			nsqEventbus.Emit("service.up", serviceInfo)
 		}
 	}()
+}
+
+func main() {
+	conflictPolicy, err := schema.ParseConflictPolicy(env.GetDefaultEnvVar("TYPE_CONFLICT_POLICY", "merge"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	servicePriorities, err := schema.ParseServicePriorities(env.GetDefaultEnvVar("SERVICE_PRIORITIES", ""))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceNamespaces, err := schema.ParseServiceNamespaces(env.GetDefaultEnvVar("SERVICE_NAMESPACES", ""))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	heartbeatInterval, err := time.ParseDuration(env.GetDefaultEnvVar("SERVICE_HEARTBEAT_INTERVAL", "1m"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceTTL, err := time.ParseDuration(env.GetDefaultEnvVar("SERVICE_TTL", "15m"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	introspectionRetries, err := strconv.Atoi(env.GetDefaultEnvVar("INTROSPECTION_RETRIES", "5"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	introspectionTimeout, err := time.ParseDuration(env.GetDefaultEnvVar("INTROSPECTION_TIMEOUT", "10s"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	introspectionBackoff, err := time.ParseDuration(env.GetDefaultEnvVar("INTROSPECTION_BACKOFF", "500ms"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	socketMaxOperations, err := strconv.Atoi(env.GetDefaultEnvVar("SOCKET_MAX_OPERATIONS", strconv.Itoa(defaultMaxSocketOperations)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if socketMaxOperations < 1 {
+		log.Fatal("SOCKET_MAX_OPERATIONS has to be at least 1")
+	}
+
+	socketInitTimeout, err := time.ParseDuration(env.GetDefaultEnvVar("SOCKET_INIT_TIMEOUT", defaultSocketInitTimeout.String()))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	newServiceProcessor := NewServiceProcessor()
+	newServiceProcessor.IntrospectionRetries = introspectionRetries
+	newServiceProcessor.IntrospectionTimeout = introspectionTimeout
+	newServiceProcessor.IntrospectionBackoff = introspectionBackoff
+	newServiceProcessor.MergedSchemas.ConflictPolicy = conflictPolicy
+	newServiceProcessor.MergedSchemas.Priorities = servicePriorities
+	newServiceProcessor.MergedSchemas.RejectDuplicateRootFields = env.GetDefaultEnvVar("REJECT_DUPLICATE_ROOT_FIELDS", "false") == "true"
+	newServiceProcessor.MergedSchemas.Namespaces = serviceNamespaces
+
+	if env.GetDefaultEnvVar("MONITOR_SERVICE_SOCKETS", "false") == "true" {
+		newServiceProcessor.MergedSchemas.ServiceDown = func(serviceInfo eventbus.ServiceInfo) {
+			newServiceProcessor.ServiceDownChannel <- serviceInfo
+		}
+	}
+
+	if heartbeatInterval > 0 && serviceTTL > 0 {
+		newServiceProcessor.StartHeartbeat(heartbeatInterval, serviceTTL)
+	}
+
+	//with a registry file nsq is only used if it is configured explicitly
+	registryFile := os.Getenv("SERVICE_REGISTRY_FILE")
+	if registryFile != "" {
+		registryInterval, err := time.ParseDuration(env.GetDefaultEnvVar("SERVICE_REGISTRY_INTERVAL", "5s"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		registryAnnounceInterval, err := time.ParseDuration(env.GetDefaultEnvVar("SERVICE_REGISTRY_ANNOUNCE_INTERVAL", "1m"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		registry := NewServiceRegistry(registryFile, newServiceProcessor)
+		if err := registry.Load(); err != nil {
+			log.Fatal(err)
+		}
+		registry.Watch(registryInterval, registryAnnounceInterval)
+	}
+
+	if registryFile == "" || os.Getenv("NSQD_TCP_URL") != "" {
+		startNsqDiscovery(newServiceProcessor)
+	}
 
 	http.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
 		body, _ := ioutil.ReadAll(r.Body)
@@ -175,7 +474,7 @@ func main() {
 		ctx = context.WithValue(ctx, "Authentication", GetAuthValue(r))
 
 		params := graphql.Params{
-			Schema:         newServiceProcessor.CurrentSchema,
+			Schema:         newServiceProcessor.GetSchema(),
 			RequestString:  opts.Query,
 			VariableValues: opts.Variables,
 			OperationName:  opts.OperationName,
@@ -188,7 +487,24 @@ func main() {
 		w.Write(buff)
 	})
 
-	http.Handle("/socket", NewSocketHandler(newServiceProcessor))
+	socketHandler := NewSocketHandler(newServiceProcessor)
+	socketHandler.MaxOperations = socketMaxOperations
+	socketHandler.InitTimeout = socketInitTimeout
+	http.Handle("/socket", socketHandler)
+
+	http.HandleFunc("/schema/report", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		buff, _ := json.Marshal(newServiceProcessor.MergedSchemas.Report())
+
+		w.Write(buff)
+	})
+
+	http.HandleFunc("/schema/pending", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		buff, _ := json.Marshal(newServiceProcessor.Pending())
+
+		w.Write(buff)
+	})
 
 	http.Handle("/metrics", promhttp.Handler())
 
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dukfaar/apiGateway/schema"
+	"github.com/dukfaar/goUtils/eventbus"
+)
+
+const inventoryResponseJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[{"kind":"OBJECT","name":"Query","fields":[
+		{"name":"stock","args":[],"type":{"kind":"SCALAR","name":"Int"}}
+	]}]
+}}}`
+
+func parseResponse(t *testing.T, responseJSON string) schema.Response {
+	var response schema.Response
+	if err := json.Unmarshal([]byte(responseJSON), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func getServerInfo(name string, server *httptest.Server) eventbus.ServiceInfo {
+	serverURL, _ := url.Parse(server.URL)
+	return eventbus.ServiceInfo{
+		Name:                name,
+		Hostname:            serverURL.Hostname(),
+		Port:                serverURL.Port(),
+		GraphQLHttpEndpoint: "/graphql",
+	}
+}
+
+func TestHeartbeatEvictsSilentServices(t *testing.T) {
+	alive := newFlakyService(0)
+	defer alive.server.Close()
+
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	deadInfo := getServerInfo("inventory", dead)
+	dead.Close()
+
+	processor := NewServiceProcessor()
+	processor.SchemaChannel <- introspectionResult{serviceInfo: alive.serviceInfo(), response: parseResponse(t, introspectionResponseJSON)}
+	processor.SchemaChannel <- introspectionResult{serviceInfo: deadInfo, response: parseResponse(t, inventoryResponseJSON)}
+
+	ttl := 100 * time.Millisecond
+	processor.StartHeartbeat(20*time.Millisecond, ttl)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(processor.MergedSchemas.Report().Services) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("silent service was not evicted: %+v", processor.MergedSchemas.Report())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//the service answering the heartbeats outlives the ttl several times
+	time.Sleep(5 * ttl)
+	if services := processor.MergedSchemas.Report().Services; len(services) != 1 || services[0] != "users" {
+		t.Errorf("unexpected services %v", services)
+	}
+	if mergedSchema := processor.GetSchema(); mergedSchema.QueryType().Fields()["ping"] == nil {
+		t.Error("answering service was evicted")
+	}
+}
+
+func TestHeartbeatDoesNotHoldUpTheWatcher(t *testing.T) {
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hanging.Close()
+	defer close(release)
+
+	processor := NewServiceProcessor()
+	processor.SchemaChannel <- introspectionResult{serviceInfo: getServerInfo("users", hanging), response: parseResponse(t, introspectionResponseJSON)}
+	processor.HeartbeatChannel <- time.Minute
+
+	handled := make(chan bool)
+	go func() {
+		processor.ServiceDownChannel <- eventbus.ServiceInfo{Name: "unknown"}
+		handled <- true
+	}()
+
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("the watcher waits for the heartbeat probes")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dukfaar/apiGateway/schema"
+	"github.com/dukfaar/goUtils/eventbus"
+	dukGraphql "github.com/dukfaar/goUtils/graphql"
+)
+
+var maxIntrospectionBackoff = 30 * time.Second
+
+// PendingService is a service instance that announced itself but has not been introspected yet
+type PendingService struct {
+	ServiceInfo eventbus.ServiceInfo `json:"serviceInfo"`
+	Since       time.Time            `json:"since"`
+	Attempts    int                  `json:"attempts"`
+	LastError   string               `json:"lastError,omitempty"`
+}
+
+// invalidIntrospectionError is a response of a service that is not a schema the gateway can merge
+type invalidIntrospectionError struct {
+	reason string
+}
+
+func (e *invalidIntrospectionError) Error() string {
+	return "Invalid introspection response: " + e.reason
+}
+
+type introspectionResult struct {
+	serviceInfo eventbus.ServiceInfo
+	response    schema.Response
+}
+
+func introspectService(serviceInfo eventbus.ServiceInfo, timeout time.Duration) (schema.Response, error) {
+	var schemaResponse schema.Response
+
+	jsonValue, _ := json.Marshal(dukGraphql.Request{
+		Query: IntrospectionQuery,
+	})
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post("http://"+serviceInfo.Hostname+":"+serviceInfo.Port+serviceInfo.GraphQLHttpEndpoint, "application/json", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return schemaResponse, err
+	}
+	defer resp.Body.Close()
+
+	//server errors are worth another attempt, any other answer but a schema will not change by asking again
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return schemaResponse, errors.New("Introspection failed with status " + resp.Status)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return schemaResponse, &invalidIntrospectionError{reason: "unexpected status " + resp.Status}
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasSuffix(mediaType, "json") {
+		return schemaResponse, &invalidIntrospectionError{reason: "unexpected content type " + resp.Header.Get("Content-Type")}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&schemaResponse); err != nil {
+		return schemaResponse, &invalidIntrospectionError{reason: err.Error()}
+	}
+
+	if err := schema.ValidateResponse(schemaResponse); err != nil {
+		return schemaResponse, &invalidIntrospectionError{reason: err.Error()}
+	}
+
+	return schemaResponse, nil
+}
+
+// getBackoffDelay spreads the retries of services that went down together, the delay is between 50% and 150% of the backoff
+func getBackoffDelay(backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		return 0
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// getNextBackoff doubles the backoff up to maxIntrospectionBackoff
+func getNextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxIntrospectionBackoff {
+		return maxIntrospectionBackoff
+	}
+
+	return backoff
+}
+
+// introspectWithRetry retries failed connections and server errors, invalid schemas are refused right away
+func (p *ServiceProcessor) introspectWithRetry(serviceInfo eventbus.ServiceInfo) (schema.Response, error) {
+	backoff := p.IntrospectionBackoff
+
+	for attempt := 1; ; attempt++ {
+		response, err := introspectService(serviceInfo, p.IntrospectionTimeout)
+		if err == nil {
+			return response, nil
+		}
+
+		p.updatePending(serviceInfo, attempt, err)
+		if _, invalid := err.(*invalidIntrospectionError); invalid {
+			invalidIntrospections.WithLabelValues(serviceInfo.Name).Inc()
+			return response, err
+		}
+
+		if attempt > p.IntrospectionRetries {
+			return response, err
+		}
+
+		time.Sleep(getBackoffDelay(backoff))
+		backoff = getNextBackoff(backoff)
+	}
+}
+
+func getPendingKey(serviceInfo eventbus.ServiceInfo) string {
+	return serviceInfo.Name + "@" + serviceInfo.Hostname + ":" + serviceInfo.Port
+}
+
+// markPending returns false if the instance is already being introspected
+func (p *ServiceProcessor) markPending(serviceInfo eventbus.ServiceInfo) bool {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+
+	key := getPendingKey(serviceInfo)
+	if _, pending := p.pending[key]; pending {
+		return false
+	}
+
+	p.pending[key] = &PendingService{
+		ServiceInfo: serviceInfo,
+		Since:       time.Now(),
+	}
+
+	return true
+}
+
+func (p *ServiceProcessor) updatePending(serviceInfo eventbus.ServiceInfo, attempts int, err error) {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+
+	if pendingService := p.pending[getPendingKey(serviceInfo)]; pendingService != nil {
+		pendingService.Attempts = attempts
+		pendingService.LastError = err.Error()
+	}
+}
+
+func (p *ServiceProcessor) clearPending(serviceInfo eventbus.ServiceInfo) {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+
+	delete(p.pending, getPendingKey(serviceInfo))
+}
+
+// Pending returns the service instances that are still being introspected
+func (p *ServiceProcessor) Pending() []PendingService {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+
+	result := make([]PendingService, 0)
+	for _, pendingService := range p.pending {
+		result = append(result, *pendingService)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return getPendingKey(result[i].ServiceInfo) < getPendingKey(result[j].ServiceInfo)
+	})
+
+	return result
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dukfaar/goUtils/eventbus"
+)
+
+const introspectionResponseJSON = `{"data":{"__schema":{
+	"queryType":{"name":"Query"},
+	"types":[{"kind":"OBJECT","name":"Query","fields":[
+		{"name":"ping","args":[],"type":{"kind":"SCALAR","name":"String"}}
+	]}]
+}}}`
+
+// flakyService fails the first attempts with a server error before it answers the introspection
+type flakyService struct {
+	server *httptest.Server
+
+	mutex    sync.Mutex
+	failures int
+	attempts int
+}
+
+func newFlakyService(failures int) *flakyService {
+	service := &flakyService{failures: failures}
+	service.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		service.mutex.Lock()
+		service.attempts++
+		failed := service.attempts <= service.failures
+		service.mutex.Unlock()
+
+		if failed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write([]byte(introspectionResponseJSON))
+	}))
+	return service
+}
+
+func (s *flakyService) getAttempts() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.attempts
+}
+
+func (s *flakyService) serviceInfo() eventbus.ServiceInfo {
+	serviceURL, _ := url.Parse(s.server.URL)
+	return eventbus.ServiceInfo{
+		Name:                "users",
+		Hostname:            serviceURL.Hostname(),
+		Port:                serviceURL.Port(),
+		GraphQLHttpEndpoint: "/graphql",
+	}
+}
+
+func newTestProcessor(retries int) *ServiceProcessor {
+	return &ServiceProcessor{
+		SchemaChannel:        make(chan introspectionResult, 10),
+		IntrospectionRetries: retries,
+		IntrospectionTimeout: time.Second,
+		IntrospectionBackoff: time.Millisecond,
+		pending:              make(map[string]*PendingService),
+	}
+}
+
+func TestGetBackoffDelay(t *testing.T) {
+	backoff := 100 * time.Millisecond
+	for i := 0; i < 1000; i++ {
+		delay := getBackoffDelay(backoff)
+		if delay < backoff/2 || delay >= backoff*3/2 {
+			t.Fatalf("delay %v out of bounds for backoff %v", delay, backoff)
+		}
+	}
+
+	if delay := getBackoffDelay(0); delay != 0 {
+		t.Errorf("delay %v without backoff", delay)
+	}
+}
+
+func TestGetNextBackoff(t *testing.T) {
+	backoffs := map[time.Duration]time.Duration{
+		500 * time.Millisecond:  time.Second,
+		10 * time.Second:        20 * time.Second,
+		20 * time.Second:        maxIntrospectionBackoff,
+		maxIntrospectionBackoff: maxIntrospectionBackoff,
+	}
+
+	for backoff, expected := range backoffs {
+		if next := getNextBackoff(backoff); next != expected {
+			t.Errorf("backoff %v grew to %v instead of %v", backoff, next, expected)
+		}
+	}
+}
+
+func TestIntrospectWithRetry(t *testing.T) {
+	service := newFlakyService(2)
+	defer service.server.Close()
+
+	processor := newTestProcessor(3)
+	serviceInfo := service.serviceInfo()
+	processor.markPending(serviceInfo)
+
+	response, err := processor.introspectWithRetry(serviceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Data.Schema.QueryType.Name != "Query" {
+		t.Errorf("unexpected response %+v", response)
+	}
+	if service.getAttempts() != 3 {
+		t.Errorf("%v attempts instead of 3", service.getAttempts())
+	}
+
+	pending := processor.Pending()
+	if len(pending) != 1 || pending[0].Attempts != 2 || pending[0].LastError == "" {
+		t.Errorf("failed attempts not recorded: %+v", pending)
+	}
+}
+
+func TestServiceUpGivesUp(t *testing.T) {
+	service := newFlakyService(100)
+	defer service.server.Close()
+
+	processor := newTestProcessor(2)
+	processor.IntrospectionBackoff = 20 * time.Millisecond
+	serviceInfo := service.serviceInfo()
+
+	processor.serviceUp(serviceInfo)
+	//announcements of an instance that is still being introspected are dropped
+	processor.serviceUp(serviceInfo)
+	if processor.markPending(serviceInfo) {
+		t.Error("instance was marked pending twice")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(processor.Pending()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("instance still pending after giving up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if service.getAttempts() != 3 {
+		t.Errorf("%v attempts instead of 3", service.getAttempts())
+	}
+	if len(processor.SchemaChannel) != 0 {
+		t.Error("schema of a failed introspection was sent")
+	}
+}
+
+func TestInvalidSchemasAreNotRetried(t *testing.T) {
+	responses := map[string]string{
+		"text/plain":       "not a schema",
+		"application/json": `{"data":{"__schema":{"queryType":{"name":"Query"},"types":[{"kind":"SCALAR","name":"Query"}]}}}`,
+	}
+
+	for contentType, body := range responses {
+		attempts := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.Header().Add("Content-Type", contentType)
+			w.Write([]byte(body))
+		}))
+
+		serviceURL, _ := url.Parse(server.URL)
+		serviceInfo := eventbus.ServiceInfo{Name: "users", Hostname: serviceURL.Hostname(), Port: serviceURL.Port()}
+
+		_, err := newTestProcessor(3).introspectWithRetry(serviceInfo)
+		server.Close()
+
+		if _, invalid := err.(*invalidIntrospectionError); !invalid {
+			t.Errorf("%v: unexpected error %v", contentType, err)
+		}
+		if attempts != 1 {
+			t.Errorf("%v: invalid schema was fetched %v times", contentType, attempts)
+		}
+	}
+}
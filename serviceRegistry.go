@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dukfaar/goUtils/eventbus"
+)
+
+// RegistryEntry describes a service in the registry file, for example
+// {"name": "users", "url": "http://users:8080/graphql", "socketEndpoint": "/socket"}.
+// Registry files are JSON, YAML is not supported
+type RegistryEntry struct {
+	Name             string                     `json:"name"`
+	URL              string                     `json:"url"`
+	SocketEndpoint   string                     `json:"socketEndpoint"`
+	SchemaExtensions []eventbus.SchemaExtension `json:"schemaExtensions"`
+}
+
+type RegistryFile struct {
+	Services []RegistryEntry `json:"services"`
+}
+
+func (e RegistryEntry) serviceInfo() (eventbus.ServiceInfo, error) {
+	if e.Name == "" {
+		return eventbus.ServiceInfo{}, errors.New("Service without a name")
+	}
+
+	serviceURL, err := url.Parse(e.URL)
+	if err != nil || serviceURL.Hostname() == "" {
+		return eventbus.ServiceInfo{}, errors.New("Invalid url of service " + e.Name + ": " + e.URL)
+	}
+
+	port := serviceURL.Port()
+	if port == "" {
+		port = "80"
+	}
+
+	return eventbus.ServiceInfo{
+		Name:                  e.Name,
+		Hostname:              serviceURL.Hostname(),
+		Port:                  port,
+		GraphQLHttpEndpoint:   serviceURL.RequestURI(),
+		GraphQLSocketEndpoint: e.SocketEndpoint,
+		SchemaExtensions:      e.SchemaExtensions,
+	}, nil
+}
+
+func readRegistryFile(filename string) ([]eventbus.ServiceInfo, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return nil, errors.New("YAML registry files are not supported, use JSON: " + filename)
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var registryFile RegistryFile
+	if err := json.Unmarshal(content, &registryFile); err != nil {
+		return nil, err
+	}
+
+	result := make([]eventbus.ServiceInfo, 0)
+	for _, entry := range registryFile.Services {
+		serviceInfo, err := entry.serviceInfo()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, serviceInfo)
+	}
+
+	return result, nil
+}
+
+func getServiceInstanceKey(serviceInfo eventbus.ServiceInfo) string {
+	return serviceInfo.Name + "@" + serviceInfo.Hostname + ":" + serviceInfo.Port
+}
+
+// ServiceRegistry feeds the services of a registry file into a ServiceProcessor and reloads the file when it changes.
+// The services are announced again regularly, so services that were down when they were announced, or were evicted, come back
+type ServiceRegistry struct {
+	filename  string
+	processor *ServiceProcessor
+	services  map[string]eventbus.ServiceInfo
+	modTime   time.Time
+	size      int64
+	announced time.Time
+}
+
+func NewServiceRegistry(filename string, processor *ServiceProcessor) *ServiceRegistry {
+	return &ServiceRegistry{
+		filename:  filename,
+		processor: processor,
+		services:  make(map[string]eventbus.ServiceInfo),
+	}
+}
+
+// Load announces the services of the file, services missing from the file since the last load are taken down
+func (r *ServiceRegistry) Load() error {
+	fileInfo, err := os.Stat(r.filename)
+	if err != nil {
+		return err
+	}
+
+	//a broken file is only read again once it changed
+	r.modTime = fileInfo.ModTime()
+	r.size = fileInfo.Size()
+
+	services, err := readRegistryFile(r.filename)
+	if err != nil {
+		return err
+	}
+
+	newServices := make(map[string]eventbus.ServiceInfo)
+	for _, serviceInfo := range services {
+		newServices[getServiceInstanceKey(serviceInfo)] = serviceInfo
+	}
+
+	for key, serviceInfo := range r.services {
+		if _, kept := newServices[key]; !kept {
+			r.processor.ServiceDownChannel <- serviceInfo
+		}
+	}
+
+	r.services = newServices
+	r.announce()
+
+	return nil
+}
+
+func (r *ServiceRegistry) announce() {
+	for _, serviceInfo := range r.services {
+		r.processor.ServiceChannel <- serviceInfo
+	}
+
+	r.announced = time.Now()
+}
+
+func (r *ServiceRegistry) changed() bool {
+	fileInfo, err := os.Stat(r.filename)
+	if err != nil {
+		fmt.Printf("Error reading service registry: %v\n", err)
+		return false
+	}
+
+	return !fileInfo.ModTime().Equal(r.modTime) || fileInfo.Size() != r.size
+}
+
+// Watch reloads the registry file whenever it changed, a file that cannot be read keeps the last loaded services.
+// Unchanged services are announced again once announceInterval passed
+func (r *ServiceRegistry) Watch(interval time.Duration, announceInterval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			<-ticker.C
+
+			if r.changed() {
+				fmt.Printf("Reloading service registry %v\n", r.filename)
+				if err := r.Load(); err != nil {
+					fmt.Printf("Error reloading service registry: %v\n", err)
+				}
+				continue
+			}
+
+			if announceInterval > 0 && time.Since(r.announced) >= announceInterval {
+				r.announce()
+			}
+		}
+	}()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dukfaar/goUtils/eventbus"
+)
+
+func writeRegistryFile(t *testing.T, filename string, content string) {
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistryEntryServiceInfo(t *testing.T) {
+	entries := []struct {
+		entry    RegistryEntry
+		expected eventbus.ServiceInfo
+	}{
+		{
+			RegistryEntry{Name: "users", URL: "http://users:8080/graphql?debug=1", SocketEndpoint: "/socket"},
+			eventbus.ServiceInfo{Name: "users", Hostname: "users", Port: "8080", GraphQLHttpEndpoint: "/graphql?debug=1", GraphQLSocketEndpoint: "/socket"},
+		},
+		{
+			RegistryEntry{Name: "inventory", URL: "http://inventory"},
+			eventbus.ServiceInfo{Name: "inventory", Hostname: "inventory", Port: "80", GraphQLHttpEndpoint: "/"},
+		},
+	}
+
+	for _, entry := range entries {
+		serviceInfo, err := entry.entry.serviceInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serviceInfo.Name != entry.expected.Name || serviceInfo.Hostname != entry.expected.Hostname ||
+			serviceInfo.Port != entry.expected.Port || serviceInfo.GraphQLHttpEndpoint != entry.expected.GraphQLHttpEndpoint ||
+			serviceInfo.GraphQLSocketEndpoint != entry.expected.GraphQLSocketEndpoint {
+			t.Errorf("unexpected service info %+v", serviceInfo)
+		}
+	}
+
+	for _, entry := range []RegistryEntry{{URL: "http://users"}, {Name: "users", URL: "users"}} {
+		if _, err := entry.serviceInfo(); err == nil {
+			t.Errorf("invalid entry %+v accepted", entry)
+		}
+	}
+}
+
+func TestReadRegistryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "services.json")
+	writeRegistryFile(t, filename, `{"services":[
+		{"name":"users","url":"http://users:8080/graphql"},
+		{"name":"inventory","url":"http://inventory:9000/api"}
+	]}`)
+
+	services, err := readRegistryFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 || services[0].Name != "users" || services[1].Port != "9000" {
+		t.Errorf("unexpected services %+v", services)
+	}
+
+	writeRegistryFile(t, filename, `{"services":[{"name":"users"}]}`)
+	if _, err := readRegistryFile(filename); err == nil {
+		t.Error("entry without url accepted")
+	}
+
+	yamlFilename := filepath.Join(dir, "services.yaml")
+	writeRegistryFile(t, yamlFilename, "services: []")
+	if _, err := readRegistryFile(yamlFilename); err == nil {
+		t.Error("yaml file accepted")
+	}
+}
+
+func TestServiceRegistryLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	processor := &ServiceProcessor{
+		ServiceChannel:     make(chan eventbus.ServiceInfo, 10),
+		ServiceDownChannel: make(chan eventbus.ServiceInfo, 10),
+	}
+
+	filename := filepath.Join(dir, "services.json")
+	writeRegistryFile(t, filename, `{"services":[
+		{"name":"users","url":"http://users-1:8080/graphql"},
+		{"name":"users","url":"http://users-2:8080/graphql"}
+	]}`)
+
+	registry := NewServiceRegistry(filename, processor)
+	if err := registry.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(processor.ServiceChannel) != 2 || len(processor.ServiceDownChannel) != 0 {
+		t.Fatalf("unexpected announcements %v up, %v down", len(processor.ServiceChannel), len(processor.ServiceDownChannel))
+	}
+	<-processor.ServiceChannel
+	<-processor.ServiceChannel
+
+	writeRegistryFile(t, filename, `{"services":[
+		{"name":"users","url":"http://users-2:8080/graphql"},
+		{"name":"inventory","url":"http://inventory:8080/graphql"}
+	]}`)
+	if err := registry.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	//kept instances are announced again, so changed schemas are picked up
+	if len(processor.ServiceChannel) != 2 || len(processor.ServiceDownChannel) != 1 {
+		t.Fatalf("unexpected announcements %v up, %v down", len(processor.ServiceChannel), len(processor.ServiceDownChannel))
+	}
+	if down := <-processor.ServiceDownChannel; down.Hostname != "users-1" {
+		t.Errorf("wrong instance taken down: %+v", down)
+	}
+
+	writeRegistryFile(t, filename, `not json`)
+	if err := registry.Load(); err == nil {
+		t.Error("broken registry file accepted")
+	}
+	if len(registry.services) != 2 {
+		t.Errorf("broken registry file dropped the loaded services: %+v", registry.services)
+	}
+}
+
+func TestServiceRegistryAnnouncesAgain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	processor := &ServiceProcessor{
+		ServiceChannel:     make(chan eventbus.ServiceInfo, 10),
+		ServiceDownChannel: make(chan eventbus.ServiceInfo, 10),
+	}
+
+	filename := filepath.Join(dir, "services.json")
+	writeRegistryFile(t, filename, `{"services":[{"name":"users","url":"http://users:8080/graphql"}]}`)
+
+	registry := NewServiceRegistry(filename, processor)
+	if err := registry.Load(); err != nil {
+		t.Fatal(err)
+	}
+	<-processor.ServiceChannel
+
+	//a service that was down when it was announced, or was evicted since, comes back without the file changing
+	registry.Watch(10*time.Millisecond, 50*time.Millisecond)
+	select {
+	case serviceInfo := <-processor.ServiceChannel:
+		if serviceInfo.Name != "users" || serviceInfo.Hostname != "users" {
+			t.Errorf("unexpected announcement %+v", serviceInfo)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("registry services were not announced again")
+	}
+	if len(processor.ServiceDownChannel) != 0 {
+		t.Errorf("unchanged registry took services down")
+	}
+}
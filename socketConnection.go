@@ -3,19 +3,49 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/dukfaar/apiGateway/schema"
 	dukGraphql "github.com/dukfaar/goUtils/graphql"
 	"github.com/gorilla/websocket"
 	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/parser"
 )
 
+// socketWriteBuffer is how many messages can wait for the writer before operations wait as well
+const socketWriteBuffer = 16
+
+type socketMessage struct {
+	msgType int
+	data    []byte
+}
+
 type SocketConnection struct {
 	ctx            context.Context
 	connection     *websocket.Conn
 	schemaProvider SchemaProvider
 	closed         bool
+
+	//protocol is the negotiated subprotocol, clients that did not ask for one speak subscriptions-transport-ws
+	protocol     string
+	acknowledged bool
+
+	//graphql-transport-ws clients that do not initialise within initTimeout are closed
+	initTimeout time.Duration
+	initialised chan struct{}
+
+	//gorilla connections do not support concurrent writers, so all messages go through one writer goroutine
+	writes chan socketMessage
+	done   chan struct{}
+
+	operationSlots  chan struct{}
+	operationsMutex sync.Mutex
+	operations      map[string]context.CancelFunc
 }
 
 type socketBaseMessage struct {
@@ -37,7 +67,7 @@ type payloadResponse struct {
 	Payload interface{} `json:"payload,omitempty"`
 }
 
-func NewSocketConnection(connection *websocket.Conn, r *http.Request, schemaProvider SchemaProvider) *SocketConnection {
+func NewSocketConnection(connection *websocket.Conn, r *http.Request, schemaProvider SchemaProvider, maxOperations int, initTimeout time.Duration) *SocketConnection {
 	sockConn := &SocketConnection{}
 
 	ctx := context.Background()
@@ -47,51 +77,258 @@ func NewSocketConnection(connection *websocket.Conn, r *http.Request, schemaProv
 	sockConn.connection = connection
 	sockConn.schemaProvider = schemaProvider
 	sockConn.closed = false
+	sockConn.protocol = connection.Subprotocol()
+	sockConn.initTimeout = initTimeout
+	sockConn.initialised = make(chan struct{})
+	sockConn.writes = make(chan socketMessage, socketWriteBuffer)
+	sockConn.done = make(chan struct{})
+	sockConn.operationSlots = make(chan struct{}, maxOperations)
+	sockConn.operations = make(map[string]context.CancelFunc)
 
 	return sockConn
 }
 
+// write queues a message for the writer, messages of a closed connection are dropped
+func (s *SocketConnection) write(msgType int, data []byte) {
+	select {
+	case s.writes <- socketMessage{msgType: msgType, data: data}:
+	case <-s.done:
+	}
+}
+
+func (s *SocketConnection) writeMessages() {
+	for {
+		select {
+		case message := <-s.writes:
+			if err := s.connection.WriteMessage(message.msgType, message.data); err != nil {
+				fmt.Printf("Error writing socket message: %v\n", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
 func (s *SocketConnection) send(r interface{}, msgType int) error {
 	responseJSON, err := json.Marshal(r)
 	if err != nil {
 		errorResponse, _ := json.Marshal(err)
-		s.connection.WriteMessage(msgType, errorResponse)
+		s.write(msgType, errorResponse)
 		return err
 	}
 
-	if err = s.connection.WriteMessage(msgType, responseJSON); err != nil {
-		errorResponse, _ := json.Marshal(err)
-		s.connection.WriteMessage(msgType, errorResponse)
-		return err
-	}
+	s.write(msgType, responseJSON)
 
 	return nil
 }
 
+func (s *SocketConnection) isTransportWs() bool {
+	return s.protocol == graphqlTransportWsProtocol
+}
+
+func (s *SocketConnection) writeClose(code int, reason string) {
+	closeMessage := websocket.FormatCloseMessage(code, reason)
+	s.connection.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+}
+
+// closeWithError ends the connection with one of the close codes of graphql-transport-ws
+func (s *SocketConnection) closeWithError(code int, reason string) {
+	s.writeClose(code, reason)
+	s.closed = true
+}
+
+// closeUninitialised closes the connection if the client does not send connection_init in time.
+// It runs beside the reader, so it closes the underlying connection to end a read that waits for the client
+func (s *SocketConnection) closeUninitialised() {
+	timer := time.NewTimer(s.initTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		s.writeClose(4408, "Connection initialisation timeout")
+		s.connection.Close()
+	case <-s.initialised:
+	case <-s.done:
+	}
+}
+
 func (s *SocketConnection) handleConnectionInit(request *socketConnectionRequest, msgType int) {
+	//the payload is optional in graphql-transport-ws
 	var connectionParams map[string]interface{}
-	err := json.Unmarshal(request.Payload, &connectionParams)
-	if err != nil {
-		fmt.Printf("Error parsing payload %v: %v\n", string(request.Payload), err)
-		return
+	if len(request.Payload) > 0 {
+		err := json.Unmarshal(request.Payload, &connectionParams)
+		if err != nil {
+			fmt.Printf("Error parsing payload %v: %v\n", string(request.Payload), err)
+			return
+		}
 	}
 
-	var authToken = connectionParams["Authentication"]
-	if authToken != nil {
-		s.ctx = context.WithValue(s.ctx, "Authentication", authToken.(string))
+	if authToken, ok := connectionParams["Authentication"].(string); ok {
+		s.ctx = context.WithValue(s.ctx, "Authentication", authToken)
 	}
+	if !s.acknowledged {
+		close(s.initialised)
+	}
+	s.acknowledged = true
 
 	var socketResponse payloadResponse
 	socketResponse.Id = request.Id
 	socketResponse.Type = "connection_ack"
-	socketResponse.Payload = "ACK"
+	if !s.isTransportWs() {
+		socketResponse.Payload = "ACK"
+	}
 	s.send(socketResponse, msgType)
 }
 
 func (s *SocketConnection) handleConnectionTerminate(request *socketConnectionRequest, msgType int) {
+	s.stopOperations()
 	s.closed = true
 }
 
+func (s *SocketConnection) sendComplete(id string, msgType int) {
+	var completeResponse simpleResponse
+	completeResponse.Id = id
+	completeResponse.Type = "complete"
+	s.send(completeResponse, msgType)
+}
+
+// sendError fails an operation, graphql-transport-ws expects a list of errors
+func (s *SocketConnection) sendError(id string, err error, msgType int) {
+	s.sendErrors(id, gqlerrors.FormatErrors(err), msgType)
+}
+
+func (s *SocketConnection) sendErrors(id string, errs []gqlerrors.FormattedError, msgType int) {
+	var socketResponse payloadResponse
+	socketResponse.Id = id
+	socketResponse.Type = "error"
+	if s.isTransportWs() {
+		socketResponse.Payload = errs
+	} else if len(errs) > 0 {
+		socketResponse.Payload = errs[0]
+	}
+	s.send(socketResponse, msgType)
+}
+
+func (s *SocketConnection) sendData(id string, result *graphql.Result, msgType int) {
+	var socketResponse payloadResponse
+	socketResponse.Id = id
+	socketResponse.Type = "data"
+	if s.isTransportWs() {
+		socketResponse.Type = "next"
+	}
+	socketResponse.Payload = result
+	s.send(socketResponse, msgType)
+}
+
+// startOperation registers an operation of the client under its id, a running operation with the same id is stopped
+func (s *SocketConnection) startOperation(id string) context.Context {
+	ctx, cancel := context.WithCancel(s.ctx)
+
+	s.operationsMutex.Lock()
+	defer s.operationsMutex.Unlock()
+
+	if previousCancel := s.operations[id]; previousCancel != nil {
+		previousCancel()
+	}
+	s.operations[id] = cancel
+
+	return ctx
+}
+
+// finishOperation removes an operation that ran to its end, it returns false if the operation was stopped or replaced meanwhile
+func (s *SocketConnection) finishOperation(id string, ctx context.Context) bool {
+	s.operationsMutex.Lock()
+	defer s.operationsMutex.Unlock()
+
+	if ctx.Err() != nil {
+		return false
+	}
+
+	s.operations[id]()
+	delete(s.operations, id)
+
+	return true
+}
+
+func (s *SocketConnection) isRunning(id string) bool {
+	s.operationsMutex.Lock()
+	defer s.operationsMutex.Unlock()
+
+	return s.operations[id] != nil
+}
+
+func (s *SocketConnection) stopOperation(id string) {
+	s.operationsMutex.Lock()
+	defer s.operationsMutex.Unlock()
+
+	if cancel := s.operations[id]; cancel != nil {
+		cancel()
+		delete(s.operations, id)
+	}
+}
+
+func (s *SocketConnection) stopOperations() {
+	s.operationsMutex.Lock()
+	defer s.operationsMutex.Unlock()
+
+	for id, cancel := range s.operations {
+		cancel()
+		delete(s.operations, id)
+	}
+}
+
+// executeQuery answers a query or mutation, the result of a stopped operation is not sent anymore
+func (s *SocketConnection) executeQuery(ctx context.Context, id string, payload dukGraphql.Request, msgType int) {
+	params := graphql.Params{
+		Schema:         s.schemaProvider.GetSchema(),
+		RequestString:  payload.Query,
+		VariableValues: payload.Variables,
+		OperationName:  payload.OperationName,
+		Context:        ctx,
+	}
+
+	result := graphql.Do(params)
+	if s.finishOperation(id, ctx) {
+		s.sendData(id, result, msgType)
+		s.sendComplete(id, msgType)
+	}
+}
+
+// executeSubscription streams the events of a subscription to the client until the service completes it or the client stops it
+func (s *SocketConnection) executeSubscription(ctx context.Context, id string, payload dukGraphql.Request, msgType int) {
+	for result := range s.schemaProvider.Subscribe(ctx, payload) {
+		if ctx.Err() != nil {
+			continue
+		}
+
+		//a result without data is a subscription that failed as a whole, graphql-transport-ws ends it with an error.
+		//Finishing the operation cancels its context, so the results left are dropped
+		if s.isTransportWs() && result.Data == nil && len(result.Errors) > 0 {
+			if s.finishOperation(id, ctx) {
+				s.sendErrors(id, result.Errors, msgType)
+			}
+			continue
+		}
+
+		s.sendData(id, result, msgType)
+	}
+
+	if s.finishOperation(id, ctx) {
+		s.sendComplete(id, msgType)
+	}
+}
+
+// validateRequest returns the errors of a request that cannot be executed at all
+func (s *SocketConnection) validateRequest(payload dukGraphql.Request) []gqlerrors.FormattedError {
+	document, err := parser.Parse(parser.ParseParams{Source: payload.Query})
+	if err != nil {
+		return gqlerrors.FormatErrors(err)
+	}
+
+	mergedSchema := s.schemaProvider.GetSchema()
+	return graphql.ValidateDocument(&mergedSchema, document, nil).Errors
+}
+
 func (s *SocketConnection) handleStart(request *socketConnectionRequest, msgType int) {
 	var payload dukGraphql.Request
 	err := json.Unmarshal(request.Payload, &payload)
@@ -100,30 +337,89 @@ func (s *SocketConnection) handleStart(request *socketConnectionRequest, msgType
 		return
 	}
 
-	params := graphql.Params{
-		Schema:         s.schemaProvider.GetSchema(),
-		RequestString:  payload.Query,
-		VariableValues: payload.Variables,
-		OperationName:  payload.OperationName,
-		Context:        s.ctx,
+	s.execute(request.Id, payload, msgType)
+}
+
+func (s *SocketConnection) handleSubscribe(request *socketConnectionRequest, msgType int) {
+	if !s.acknowledged {
+		s.closeWithError(4401, "Unauthorized")
+		return
 	}
 
-	var socketResponse payloadResponse
-	socketResponse.Id = request.Id
-	socketResponse.Type = "data"
-	socketResponse.Payload = graphql.Do(params)
-	s.send(socketResponse, msgType)
+	if s.isRunning(request.Id) {
+		s.closeWithError(4409, "Subscriber for "+request.Id+" already exists")
+		return
+	}
 
-	var completeResponse simpleResponse
-	completeResponse.Id = request.Id
-	completeResponse.Type = "complete"
-	s.send(completeResponse, msgType)
+	var payload dukGraphql.Request
+	if err := json.Unmarshal(request.Payload, &payload); err != nil {
+		s.closeWithError(4400, "Invalid subscribe payload")
+		return
+	}
+
+	//graphql-transport-ws reports requests that cannot be executed with an error message instead of a result
+	if errs := s.validateRequest(payload); len(errs) > 0 {
+		s.sendErrors(request.Id, errs, msgType)
+		return
+	}
+
+	s.execute(request.Id, payload, msgType)
+}
+
+func (s *SocketConnection) execute(id string, payload dukGraphql.Request, msgType int) {
+	//a client over its limit gets an error instead of blocking the messages of its other operations
+	select {
+	case s.operationSlots <- struct{}{}:
+	default:
+		s.sendError(id, errors.New("Too many operations in flight"), msgType)
+		return
+	}
+
+	//operations run on their own, so a slow operation does not hold up the others and a stop can reach it
+	ctx := s.startOperation(id)
+	go func() {
+		defer func() { <-s.operationSlots }()
+
+		if schema.IsSubscription(payload) {
+			s.executeSubscription(ctx, id, payload, msgType)
+		} else {
+			s.executeQuery(ctx, id, payload, msgType)
+		}
+	}()
 }
 
 func (s *SocketConnection) handleStop(request *socketConnectionRequest, msgType int) {
+	s.stopOperation(request.Id)
+}
+
+func (s *SocketConnection) processTransportWsMessage(request *socketConnectionRequest, msgType int) {
+	switch request.Type {
+	case "connection_init":
+		if s.acknowledged {
+			s.closeWithError(4429, "Too many initialisation requests")
+			return
+		}
+		s.handleConnectionInit(request, msgType)
+	case "ping":
+		var pongResponse simpleResponse
+		pongResponse.Type = "pong"
+		s.send(pongResponse, msgType)
+	case "pong":
+	case "subscribe":
+		s.handleSubscribe(request, msgType)
+	case "complete":
+		s.handleStop(request, msgType)
+	default:
+		s.closeWithError(4400, "Unknown message type "+request.Type)
+	}
 }
 
 func (s *SocketConnection) processMessage(request *socketConnectionRequest, msgType int) {
+	if s.isTransportWs() {
+		s.processTransportWsMessage(request, msgType)
+		return
+	}
+
 	switch request.Type {
 	case "connection_init":
 		s.handleConnectionInit(request, msgType)
@@ -134,14 +430,19 @@ func (s *SocketConnection) processMessage(request *socketConnectionRequest, msgT
 	case "stop":
 		s.handleStop(request, msgType)
 	default:
-		panic("Unknown socket-request-type: " + request.Type)
-		s.closed = true
+		s.sendError(request.Id, errors.New("Unknown message type "+request.Type), msgType)
 	}
 }
 
 func (s *SocketConnection) ProcessMessages() {
 	fmt.Println("Start processing messages")
 	defer fmt.Println("Stop processing messages")
+
+	go s.writeMessages()
+	if s.isTransportWs() {
+		go s.closeUninitialised()
+	}
+
 	for {
 		if s.closed {
 			break
@@ -158,12 +459,20 @@ func (s *SocketConnection) ProcessMessages() {
 		request := &socketConnectionRequest{}
 
 		if err = json.Unmarshal(message, &request); err != nil {
+			if s.isTransportWs() {
+				s.closeWithError(4400, "Invalid message")
+				break
+			}
+
 			errorResponse, _ := json.Marshal(err)
-			s.connection.WriteMessage(msgType, errorResponse)
+			s.write(msgType, errorResponse)
+			continue
 		}
 
 		s.processMessage(request, msgType)
 	}
 
+	s.stopOperations()
+	close(s.done)
 	s.connection.Close()
 }
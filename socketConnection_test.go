@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dukGraphql "github.com/dukfaar/goUtils/graphql"
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// fakeSchemaProvider answers slow queries only once they are stopped and streams a counter to every subscription,
+// subscriptions of a broken field fail as a whole
+type fakeSchemaProvider struct {
+	schema  graphql.Schema
+	stopped chan bool
+}
+
+func newFakeSchemaProvider(t *testing.T) *fakeSchemaProvider {
+	provider := &fakeSchemaProvider{stopped: make(chan bool, 10)}
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: graphql.Fields{
+			"slow": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				<-p.Context.Done()
+				provider.stopped <- true
+				return nil, p.Context.Err()
+			}},
+			"fast": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return "fast", nil
+			}},
+		}}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{Name: "Subscription", Fields: graphql.Fields{
+			"counter": &graphql.Field{Type: graphql.Int},
+		}}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.schema = schema
+
+	return provider
+}
+
+func (p *fakeSchemaProvider) GetSchema() graphql.Schema {
+	return p.schema
+}
+
+func (p *fakeSchemaProvider) Subscribe(ctx context.Context, request dukGraphql.Request) <-chan *graphql.Result {
+	results := make(chan *graphql.Result)
+	go func() {
+		defer close(results)
+
+		if strings.Contains(request.Query, "broken") {
+			results <- &graphql.Result{Errors: gqlerrors.FormatErrors(errors.New("Subscription failed"))}
+			return
+		}
+
+		for i := 0; ; i++ {
+			select {
+			case results <- &graphql.Result{Data: map[string]interface{}{"counter": i}}:
+				time.Sleep(time.Millisecond)
+			case <-ctx.Done():
+				p.stopped <- true
+				return
+			}
+		}
+	}()
+	return results
+}
+
+func newSocketServer(t *testing.T, maxOperations int) (*httptest.Server, *fakeSchemaProvider) {
+	provider := newFakeSchemaProvider(t)
+
+	handler := NewSocketHandler(provider)
+	handler.MaxOperations = maxOperations
+	handler.InitTimeout = 100 * time.Millisecond
+
+	return httptest.NewServer(handler), provider
+}
+
+func dialSocket(t *testing.T, server *httptest.Server, protocols ...string) *websocket.Conn {
+	dialer := websocket.Dialer{Subprotocols: protocols}
+	c, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return c
+}
+
+func sendMessage(t *testing.T, c *websocket.Conn, id string, messageType string, payload interface{}) {
+	message := map[string]interface{}{"type": messageType}
+	if id != "" {
+		message["id"] = id
+	}
+	if payload != nil {
+		message["payload"] = payload
+	}
+
+	if err := c.WriteJSON(message); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readMessage(t *testing.T, c *websocket.Conn) map[string]interface{} {
+	var message map[string]interface{}
+	if err := c.ReadJSON(&message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+// readUntil skips messages until one of the given type for the given id arrives
+func readUntil(t *testing.T, c *websocket.Conn, id string, messageType string) map[string]interface{} {
+	for {
+		message := readMessage(t, c)
+		if message["id"] == id && message["type"] == messageType {
+			return message
+		}
+	}
+}
+
+func expectClose(t *testing.T, c *websocket.Conn, code int) {
+	for {
+		var message map[string]interface{}
+		err := c.ReadJSON(&message)
+		if err == nil {
+			continue
+		}
+
+		if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != code {
+			t.Errorf("expected close code %v, got %v", code, err)
+		}
+		return
+	}
+}
+
+func expectStopped(t *testing.T, provider *fakeSchemaProvider, count int) {
+	for i := 0; i < count; i++ {
+		select {
+		case <-provider.stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v of %v operations were stopped", i, count)
+		}
+	}
+}
+
+func query(query string) map[string]interface{} {
+	return map[string]interface{}{"query": query}
+}
+
+func TestSocketSubprotocolNegotiation(t *testing.T) {
+	server, _ := newSocketServer(t, 16)
+	defer server.Close()
+
+	entries := []struct {
+		protocols []string
+		expected  string
+	}{
+		{[]string{graphqlTransportWsProtocol, graphqlWsProtocol}, graphqlTransportWsProtocol},
+		{[]string{graphqlWsProtocol}, graphqlWsProtocol},
+		{nil, ""},
+	}
+
+	for _, entry := range entries {
+		c := dialSocket(t, server, entry.protocols...)
+		if c.Subprotocol() != entry.expected {
+			t.Errorf("%v negotiated %v", entry.protocols, c.Subprotocol())
+		}
+		c.Close()
+	}
+}
+
+func TestSocketOperationsRunConcurrently(t *testing.T) {
+	server, provider := newSocketServer(t, 3)
+	defer server.Close()
+
+	c := dialSocket(t, server, graphqlWsProtocol)
+	defer c.Close()
+
+	sendMessage(t, c, "", "connection_init", map[string]interface{}{})
+	if ack := readMessage(t, c); ack["type"] != "connection_ack" || ack["payload"] != "ACK" {
+		t.Errorf("unexpected acknowledgement %v", ack)
+	}
+
+	sendMessage(t, c, "1", "start", query("subscription { counter }"))
+	sendMessage(t, c, "2", "start", query("{ slow }"))
+	sendMessage(t, c, "3", "start", query("{ fast }"))
+
+	//the fast query is answered while the subscription and the slow query are still running
+	result := readUntil(t, c, "3", "data")
+	if data := result["payload"].(map[string]interface{})["data"].(map[string]interface{}); data["fast"] != "fast" {
+		t.Errorf("unexpected result %v", result)
+	}
+	readUntil(t, c, "3", "complete")
+
+	sendMessage(t, c, "1", "stop", nil)
+	expectStopped(t, provider, 1)
+
+	//operations still running are stopped with the connection
+	c.Close()
+	expectStopped(t, provider, 1)
+}
+
+func TestSocketOperationLimit(t *testing.T) {
+	server, provider := newSocketServer(t, 2)
+	defer server.Close()
+
+	c := dialSocket(t, server, graphqlWsProtocol)
+	defer c.Close()
+
+	sendMessage(t, c, "", "connection_init", map[string]interface{}{})
+	sendMessage(t, c, "1", "start", query("{ slow }"))
+	sendMessage(t, c, "2", "start", query("{ slow }"))
+	sendMessage(t, c, "3", "start", query("{ fast }"))
+
+	result := readUntil(t, c, "3", "error")
+	if payload := result["payload"].(map[string]interface{}); payload["message"] != "Too many operations in flight" {
+		t.Errorf("unexpected error %v", result)
+	}
+
+	sendMessage(t, c, "1", "stop", nil)
+	sendMessage(t, c, "2", "stop", nil)
+	expectStopped(t, provider, 2)
+}
+
+func TestSocketMessagesAreWrittenByOneWriter(t *testing.T) {
+	server, provider := newSocketServer(t, 16)
+	defer server.Close()
+
+	c := dialSocket(t, server, graphqlWsProtocol)
+
+	sendMessage(t, c, "", "connection_init", map[string]interface{}{})
+	ids := []string{"1", "2", "3", "4"}
+	for _, id := range ids {
+		sendMessage(t, c, id, "start", query("subscription { counter }"))
+	}
+
+	//concurrent writers would corrupt the frames or make gorilla panic
+	received := make(map[interface{}]int)
+	for i := 0; i < 200; i++ {
+		message := readMessage(t, c)
+		if message["type"] == "data" {
+			received[message["id"]]++
+		}
+	}
+	for _, id := range ids {
+		if received[id] == 0 {
+			t.Errorf("no events of subscription %v", id)
+		}
+	}
+
+	c.Close()
+	expectStopped(t, provider, len(ids))
+}
+
+func TestSocketUnknownMessagesAreAnswered(t *testing.T) {
+	server, _ := newSocketServer(t, 16)
+	defer server.Close()
+
+	c := dialSocket(t, server, graphqlWsProtocol)
+	defer c.Close()
+
+	if err := c.WriteMessage(websocket.TextMessage, []byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+	readMessage(t, c)
+
+	sendMessage(t, c, "1", "unknown", nil)
+	result := readUntil(t, c, "1", "error")
+	if payload := result["payload"].(map[string]interface{}); payload["message"] != "Unknown message type unknown" {
+		t.Errorf("unexpected error %v", result)
+	}
+
+	//the connection is still served
+	sendMessage(t, c, "2", "start", query("{ fast }"))
+	readUntil(t, c, "2", "complete")
+}
+
+func TestTransportWsOperations(t *testing.T) {
+	server, provider := newSocketServer(t, 16)
+	defer server.Close()
+
+	c := dialSocket(t, server, graphqlTransportWsProtocol)
+	defer c.Close()
+
+	sendMessage(t, c, "", "connection_init", nil)
+	if ack := readMessage(t, c); ack["type"] != "connection_ack" || ack["payload"] != nil {
+		t.Errorf("unexpected acknowledgement %v", ack)
+	}
+
+	sendMessage(t, c, "", "ping", nil)
+	if pong := readMessage(t, c); pong["type"] != "pong" {
+		t.Errorf("unexpected answer to ping %v", pong)
+	}
+
+	sendMessage(t, c, "q", "subscribe", query("{ fast }"))
+	if next := readMessage(t, c); next["id"] != "q" || next["type"] != "next" {
+		t.Errorf("unexpected result %v", next)
+	}
+	if complete := readMessage(t, c); complete["id"] != "q" || complete["type"] != "complete" {
+		t.Errorf("unexpected completion %v", complete)
+	}
+
+	//requests that cannot be executed are answered with a list of errors and nothing else
+	for _, invalid := range []string{"{ unknown }", "{ fast"} {
+		sendMessage(t, c, "invalid", "subscribe", query(invalid))
+		result := readMessage(t, c)
+		if errs, ok := result["payload"].([]interface{}); result["type"] != "error" || !ok || len(errs) == 0 {
+			t.Errorf("%v answered with %v", invalid, result)
+		}
+	}
+
+	sendMessage(t, c, "failing", "subscribe", query("subscription { broken: counter }"))
+	if result := readMessage(t, c); result["id"] != "failing" || result["type"] != "error" {
+		t.Errorf("failed subscription answered with %v", result)
+	}
+
+	sendMessage(t, c, "s", "subscribe", query("subscription { counter }"))
+	readUntil(t, c, "s", "next")
+	sendMessage(t, c, "s", "complete", nil)
+	expectStopped(t, provider, 1)
+
+	sendMessage(t, c, "s", "subscribe", query("subscription { counter }"))
+	readUntil(t, c, "s", "next")
+	sendMessage(t, c, "s", "subscribe", query("subscription { counter }"))
+	expectClose(t, c, 4409)
+	expectStopped(t, provider, 1)
+}
+
+func TestTransportWsCloseCodes(t *testing.T) {
+	server, _ := newSocketServer(t, 16)
+	defer server.Close()
+
+	c := dialSocket(t, server, graphqlTransportWsProtocol)
+	sendMessage(t, c, "1", "subscribe", query("{ fast }"))
+	expectClose(t, c, 4401)
+	c.Close()
+
+	c = dialSocket(t, server, graphqlTransportWsProtocol)
+	if err := c.WriteMessage(websocket.TextMessage, []byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+	expectClose(t, c, 4400)
+	c.Close()
+
+	c = dialSocket(t, server, graphqlTransportWsProtocol)
+	sendMessage(t, c, "", "connection_init", nil)
+	readMessage(t, c)
+	sendMessage(t, c, "", "connection_init", nil)
+	expectClose(t, c, 4429)
+	c.Close()
+
+	c = dialSocket(t, server, graphqlTransportWsProtocol)
+	expectClose(t, c, 4408)
+	c.Close()
+}
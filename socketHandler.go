@@ -4,13 +4,29 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// the subprotocols the socket understands, in order of preference
+const (
+	graphqlTransportWsProtocol = "graphql-transport-ws"
+	graphqlWsProtocol          = "graphql-ws"
+)
+
+// defaultMaxSocketOperations is how many operations a socket connection runs at the same time
+const defaultMaxSocketOperations = 16
+
+// defaultSocketInitTimeout is how long a graphql-transport-ws client has to send connection_init
+const defaultSocketInitTimeout = 3 * time.Second
+
 type SocketHandler struct {
 	upgrader       websocket.Upgrader
 	schemaProvider SchemaProvider
+
+	MaxOperations int
+	InitTimeout   time.Duration
 }
 
 func NewSocketHandler(schemaProvider SchemaProvider) *SocketHandler {
@@ -22,25 +38,25 @@ func NewSocketHandler(schemaProvider SchemaProvider) *SocketHandler {
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
+		Subprotocols: []string{graphqlTransportWsProtocol, graphqlWsProtocol},
 	}
 
 	result.schemaProvider = schemaProvider
+	result.MaxOperations = defaultMaxSocketOperations
+	result.InitTimeout = defaultSocketInitTimeout
 
 	return result
 }
 
 func (s *SocketHandler) createConnection(w http.ResponseWriter, r *http.Request) (*SocketConnection, error) {
-	protocols := websocket.Subprotocols(r)
-	header := make(http.Header)
-	header["Sec-WebSocket-Protocol"] = protocols
-	connection, upgradeError := s.upgrader.Upgrade(w, r, header)
+	connection, upgradeError := s.upgrader.Upgrade(w, r, nil)
 
 	if upgradeError != nil {
 		log.Println(upgradeError)
 		return nil, upgradeError
 	}
 
-	return NewSocketConnection(connection, r, s.schemaProvider), nil
+	return NewSocketConnection(connection, r, s.schemaProvider, s.MaxOperations, s.InitTimeout), nil
 }
 
 func (s *SocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {